@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Album management
+//
+// GET    /api/albums                      lists albums
+// POST   /api/albums?album=A              creates album A, A can be nested like Music/Artist/Album
+//                                         but its parent album must exist
+// PUT    /api/albums?album=A&name=B       renames album A to B under the same parent
+// DELETE /api/albums?album=A[&force]      deletes album A, force is required when not empty
+
+const QUERY_NAME = "name"
+const QUERY_FORCE = "force"
+
+func validateAlbumName(name string) error {
+
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("Invalid album name %q", name)
+	}
+	if filepath.Base(name) != name {
+		return fmt.Errorf("Album name cannot be a path %q", name)
+	}
+	if strings.Contains(name, META_SLASH_IN_FILENAME) {
+		return fmt.Errorf("Album name cannot contain %s", META_SLASH_IN_FILENAME)
+	}
+
+	return nil
+
+}
+
+func apiAlbums(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	if r.Method == http.MethodGet {
+		albums := make([]string, 0)
+		for _, dir := range gMetadataManager.Dirs() {
+			albums = append(albums, getAlbumOfDir(dir))
+		}
+		serveJson(w, r, albums)
+		return
+	}
+
+	// ---
+	album := cleanAlbumPath(query.Get(QUERY_ALBUM))
+	for _, name := range strings.Split(album, string(filepath.Separator)) {
+		if err := validateAlbumName(name); err != nil {
+			logHTTPRequest(r, -1, "validateAlbumName err:", err)
+			http.Error(w, "Invalid album name", http.StatusBadRequest)
+			return
+		}
+	}
+	dir := filepath.Join(gAppInfo.UploadDir, album)
+	parentDir := filepath.Dir(dir)
+	album = filepath.Base(dir)
+
+	if _, ok := gMetadataManager.getCache(parentDir); !ok {
+		logHTTPRequest(r, -1, "Parent album not found:", parentDir)
+		http.Error(w, "Parent album not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+
+		if _, ok := gMetadataManager.getCache(dir); ok {
+			logHTTPRequest(r, -1, "Album already exists:", dir)
+			http.Error(w, "Album already exists", http.StatusConflict)
+			return
+		}
+
+		// Existing directory not yet registered is just registered
+		err := os.Mkdir(dir, 0755)
+		if err != nil && !os.IsExist(err) {
+			logHTTPRequest(r, -1, "os.Mkdir err:", err)
+			http.Error(w, "Failed to create album", http.StatusInternalServerError)
+			return
+		}
+
+		gMetadataManager.AddDir(dir)
+		err = gMetadataManager.UpdateDir(dir)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to cache album err:", err)
+			http.Error(w, "Failed to cache album", http.StatusInternalServerError)
+			return
+		}
+
+		info, err := ioStat(dir)
+		if err == nil {
+			err = gMetadataManager.SetMetadata(parentDir, album, info, "")
+		}
+		if err != nil {
+			logWarn("Failed to set metadata of", dir, err)
+		}
+
+		logHTTPRequest(r, -1, "ALBUM CREATED", album)
+
+	case http.MethodPut:
+
+		name := query.Get(QUERY_NAME)
+		if err := validateAlbumName(name); err != nil {
+			logHTTPRequest(r, -1, "validateAlbumName err:", err)
+			http.Error(w, "Invalid album name", http.StatusBadRequest)
+			return
+		}
+		newDir := filepath.Join(parentDir, name)
+
+		if fileExists(newDir) {
+			logHTTPRequest(r, -1, "Album already exists:", newDir)
+			http.Error(w, "Album already exists", http.StatusConflict)
+			return
+		}
+
+		err := gMetadataManager.RenameDir(dir, newDir)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to rename album err:", err)
+			http.Error(w, "Failed to rename album", http.StatusBadRequest)
+			return
+		}
+
+		info, err := ioStat(newDir)
+		if err == nil {
+			gMetadataManager.RemoveMetadata(parentDir, album)
+			err = gMetadataManager.SetMetadata(parentDir, name, info, "")
+		}
+		if err != nil {
+			logWarn("Failed to set metadata of", newDir, err)
+		}
+
+		logHTTPRequest(r, -1, "ALBUM RENAMED", album, name)
+
+	case http.MethodDelete:
+
+		dentries, err := ioReadDir(dir)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to read album err:", err)
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		if len(dentries) > 0 && !query.Has(QUERY_FORCE) {
+			logHTTPRequest(r, -1, "Album is not empty:", dir)
+			http.Error(w, "Album is not empty", http.StatusConflict)
+			return
+		}
+
+		err = gMetadataManager.RemoveDir(dir)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to delete album err:", err)
+			http.Error(w, "Failed to delete album", http.StatusInternalServerError)
+			return
+		}
+		gMetadataManager.RemoveMetadata(parentDir, album)
+
+		logHTTPRequest(r, -1, "ALBUM DELETED", album)
+
+	default:
+
+		logHTTPRequest(r, -1, "Invalid method for albums")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+
+	}
+
+}
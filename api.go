@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"encoding/json"
+	"errors"
 	"strings"
 )
 
@@ -23,6 +24,18 @@ func init() {
 	// ---
 	apiMux.HandleFunc("/api/manifest", makeApiManifest())
 	apiMux.HandleFunc("/api/bakeMetadata", apiBakeMetadata)
+	apiMux.HandleFunc("/api/duplicates", apiDuplicates)
+	apiMux.HandleFunc("/api/albums", apiAlbums)
+	apiMux.HandleFunc("/api/files", apiFiles)
+	apiMux.HandleFunc("/api/events", apiEvents)
+	apiMux.HandleFunc("/api/playlists", apiPlaylists)
+	apiMux.HandleFunc("/api/playlistFile", apiPlaylistFile)
+	apiMux.HandleFunc("/api/plays", apiPlays)
+	apiMux.HandleFunc("/api/history", apiHistory)
+	apiMux.HandleFunc("/api/smartPlaylist", apiSmartPlaylist)
+	apiMux.HandleFunc("/api/playback", apiPlayback)
+	apiMux.HandleFunc("/api/devices", apiDevices)
+	apiMux.HandleFunc("/api/timeline", apiTimeline)
 
 }
 
@@ -83,7 +96,10 @@ func apiBakeMetadata(w http.ResponseWriter, r *http.Request) {
 		cmd.Args[cmd.Output] = getMetadataFullpath(info.Album, info.Base, cmd.OutputExt)
 		logDebug(strings.Join(cmd.Args, " "))
 		err = executeFFmpeg(cmd.Args, nil, nil)
-		if err != nil {
+		if errors.Is(err, errFFmpegExit) {
+			// e.g. audio without artwork, the client checks the outputs
+			logHTTPRequest(r, -1, cmd.OutputExt, err)
+		} else if err != nil {
 			logHTTPRequest(r, -1, "failed to run native ffmpeg:", err)
 			http.Error(w, "failed to run native ffmpeg", http.StatusInternalServerError)
 			return
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata baking
+//
+// New or modified media found by _update or set by uploads are queued and the metadata files
+// (ffprobe json and thumbnails) are made by the native ffmpeg so that they exist
+// even if no browser opens the album. The result is recorded in Metadata.Bake per file
+// and a file is baked again only when its ModTime changes, or when it was baked before
+// a feature of gBakeFeatures which it lacks.
+// The ffprobe json is parsed into Metadata.Media, audio is analyzed into Metadata.Loudness
+// and videos get the sprite sheet of Metadata.Sprite. HEIF photos get the JPEG of Metadata.Display.
+// Audio also gets the waveform of Metadata.Waveform.
+
+// Raised when baking makes more so that files baked before are baked again
+const BAKE_VERSION = 2
+// Bakes are skipped for the while after finding no native ffmpeg, rescans queue them again
+const BAKE_NO_FFMPEG_RETRY = time.Minute * 10
+
+type MetadataBake struct {
+	ModTime		time.Time	`json:"modTime"` // of the baked file
+	Version		int			`json:"version,omitempty"`
+	Error		string		`json:"error,omitempty"`
+}
+
+// Made from the files baked by the commands
+type bakeResult struct {
+	Media		*MediaInfo
+	Loudness	*MetadataLoudness
+	Sprite		*MetadataSprite
+	Waveform	*MetadataWaveform
+}
+
+type bakeCommand struct {
+	Input		int
+	Output		int
+	OutputExt	string
+	Required	bool
+	MimeTypes	[]string
+	Args		[]string
+}
+
+// Same as the commands of the client, except the HEIF ones baked only here
+var gBakeCommands = []bakeCommand{
+	{
+		Input:		2,
+		Output:		9,
+		OutputExt:	META_EXT_TXT,
+		Required:	true,
+		MimeTypes:	[]string{"audio/*", "video/*", "*/webp", MIME_HEIC, MIME_HEIF},
+		Args:		[]string{
+			"ffprobe", "-i", "",
+			"-show_format",
+			"-show_entries", "stream=codec_type,codec_name,bit_rate,sample_rate,channels,width,height:stream_tags:stream_disposition=attached_pic",
+			"-print_format", "json",
+			"-o", "",
+		},
+	},
+	{
+		Input:		2,
+		Output:		16,
+		OutputExt:	META_EXT_THUMB,
+		MimeTypes:	[]string{"video/*", "*/webp"},
+		Args:		[]string{
+			"ffmpeg", "-i", "",
+			"-c:v", "libwebp",
+			"-threads", "1",
+			"-q:v", "80",
+			"-pix_fmt", "yuv420p",
+			"-an",
+			"-ss", "00:00:01",
+			"-vframes", "1",
+			"",
+		},
+	},
+	{
+		Input:		2,
+		Output:		11,
+		OutputExt:	META_EXT_DISPLAY,
+		Required:	true,
+		MimeTypes:	[]string{MIME_HEIC, MIME_HEIF},
+		Args:		[]string{
+			"ffmpeg", "-i", "",
+			"-frames:v", "1",
+			"-c:v", "mjpeg",
+			"-q:v", "3",
+			"-pix_fmt", "yuvj420p",
+			"",
+		},
+	},
+	{
+		Input:		2,
+		Output:		15,
+		OutputExt:	META_EXT_THUMB,
+		MimeTypes:	[]string{MIME_HEIC, MIME_HEIF},
+		Args:		[]string{
+			"ffmpeg", "-i", "",
+			"-c:v", "libwebp",
+			"-threads", "1",
+			"-q:v", "80",
+			"-pix_fmt", "yuv420p",
+			"-vf", "scale=480:-2",
+			"-frames:v", "1",
+			"",
+		},
+	},
+	{
+		Input:		2,
+		Output:		12,
+		OutputExt:	META_EXT_THUMB,
+		MimeTypes:	[]string{"audio/*"},
+		Args:		[]string{
+			"ffmpeg", "-i", "",
+			"-c:v", "libwebp",
+			"-threads", "1",
+			"-q:v", "80",
+			"-pix_fmt", "yuv420p",
+			"-an",
+			"",
+		},
+	},
+	{
+		Input:		2,
+		Output:		14,
+		OutputExt:	META_EXT_THUMB_SMALL,
+		MimeTypes:	[]string{"audio/*"},
+		Args:		[]string{
+			"ffmpeg", "-i", "",
+			"-c:v", "libwebp",
+			"-threads", "1",
+			"-q:v", "80",
+			"-pix_fmt", "yuv420p",
+			"-an",
+			"-vf", "scale=iw*sqrt(16384/(iw*ih)):-1",
+			"",
+		},
+	},
+}
+
+// A part of the bake, files baked before its version that lack it are baked again
+type bakeFeature struct {
+	Name		string
+	Version		int // BAKE_VERSION which added it
+	MimeTypes	[]string
+	Baked		func(meta *Metadata) bool
+}
+
+var gBakeFeatures = []bakeFeature{
+	{
+		Name:		"media",
+		Version:	2, // full ffprobe json
+		MimeTypes:	[]string{"audio/*", "video/*", "*/webp", MIME_HEIC, MIME_HEIF},
+		Baked:		func(meta *Metadata) bool {
+			return meta.Media != nil && !meta.Media.lacksStreams()
+		},
+	},
+	{
+		Name:		"loudness",
+		Version:	1,
+		MimeTypes:	[]string{"audio/*"},
+		Baked:		func(meta *Metadata) bool {
+			return meta.Loudness != nil
+		},
+	},
+	{
+		Name:		"waveform",
+		Version:	2,
+		MimeTypes:	[]string{"audio/*"},
+		Baked:		func(meta *Metadata) bool {
+			return meta.Waveform != nil
+		},
+	},
+	{
+		Name:		"sprite",
+		Version:	2,
+		MimeTypes:	[]string{"video/*"},
+		Baked:		func(meta *Metadata) bool {
+			// Not for audio only ones
+			return meta.Sprite != nil || (meta.Media != nil && meta.Media.VideoCodec == "")
+		},
+	},
+	{
+		Name:		"display",
+		Version:	2,
+		MimeTypes:	[]string{MIME_HEIC, MIME_HEIF},
+		Baked:		func(meta *Metadata) bool {
+			return meta.Display != nil
+		},
+	},
+}
+
+func (cmd *bakeCommand) eligible(mimeType string) bool {
+	return matchMimeType(mimeType, cmd.MimeTypes)
+}
+
+// matchMimeType tells whether the mime type matches one of the conditions, * matches any part
+func matchMimeType(mimeType string, conds []string) bool {
+
+	parts := strings.SplitN(mimeType, "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	for _, cond := range conds {
+		partsCond := strings.SplitN(cond, "/", 2)
+		if (partsCond[0] == "*" || partsCond[0] == parts[0]) &&
+			(partsCond[1] == "*" || partsCond[1] == parts[1]) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+func isAudio(mimeType string) bool {
+	return strings.SplitN(mimeType, "/", 2)[0] == MIME_AUDIO
+}
+
+func isVideo(mimeType string) bool {
+	return strings.SplitN(mimeType, "/", 2)[0] == MIME_VIDEO
+}
+
+func isBakeable(mimeType string) bool {
+	for _, cmd := range gBakeCommands {
+		if cmd.eligible(mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+type bakeJob struct {
+	dir			string
+	base		string
+	modTime		time.Time
+	mimeType	string
+	force		bool // rebake the existing metadata files
+}
+
+type MetadataBaker struct {
+	mgr			*MetadataManager
+
+	queue		[]string
+	jobs		map[string]bakeJob
+	noFFmpeg	time.Time // when a bake last found no native ffmpeg
+	mu			sync.Mutex
+	cond		*sync.Cond
+}
+
+func NewMetadataBaker(mgr *MetadataManager, workers int) *MetadataBaker {
+
+	baker := &MetadataBaker{}
+
+	baker.mgr	= mgr
+	baker.queue	= make([]string, 0)
+	baker.jobs	= make(map[string]bakeJob)
+	baker.cond	= sync.NewCond(&baker.mu)
+
+	// ffmpegSempahore limits the actual processes
+	for i := 0; i < workers; i++ {
+		go baker.work()
+	}
+
+	return baker
+
+}
+
+// scheduleBake must be called while holding cache.bodyMu
+func (cache *metadataCache) scheduleBake(base string, meta *Metadata) {
+
+	if meta.IsDir || !isBakeable(meta.MimeType) {
+		return
+	}
+
+	force := meta.Bake != nil
+	if meta.Bake != nil && meta.Bake.ModTime.Equal(meta.ModTime) {
+		if !meta.bakeOutdated() {
+			return
+		}
+		force = false
+	}
+
+	cache.mgr.baker.enqueue(bakeJob{
+		dir:		cache.dir,
+		base:		base,
+		modTime:	meta.ModTime,
+		mimeType:	meta.MimeType,
+		force:		force,
+	})
+
+}
+
+// bakeOutdated tells whether the file baked at its ModTime is baked again,
+// for failing before the version or lacking a feature added after its bake
+func (meta *Metadata) bakeOutdated() bool {
+
+	if meta.Bake.Version >= BAKE_VERSION {
+		return false
+	}
+	if meta.Bake.Error != "" {
+		return true
+	}
+
+	for _, feature := range gBakeFeatures {
+		if meta.Bake.Version < feature.Version && matchMimeType(meta.MimeType, feature.MimeTypes) && !feature.Baked(meta) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+func (baker *MetadataBaker) enqueue(job bakeJob) {
+
+	baker.mu.Lock()
+	defer baker.mu.Unlock()
+
+	if time.Since(baker.noFFmpeg) < BAKE_NO_FFMPEG_RETRY {
+		return
+	}
+
+	// Queued one is replaced keeping its position
+	key := filepath.Join(job.dir, job.base)
+	if _, ok := baker.jobs[key]; !ok {
+		baker.queue = append(baker.queue, key)
+	}
+	baker.jobs[key] = job
+
+	baker.cond.Signal()
+
+}
+
+func (baker *MetadataBaker) work() {
+
+	for {
+
+		baker.mu.Lock()
+		for len(baker.queue) == 0 {
+			baker.cond.Wait()
+		}
+		key := baker.queue[0]
+		baker.queue = baker.queue[1:]
+		job := baker.jobs[key]
+		delete(baker.jobs, key)
+		baker.mu.Unlock()
+
+		result, err := baker.bake(job)
+		if errors.Is(err, errNoNativeFFmpeg) {
+			// Not recorded so that it is baked once ffmpeg is installed, the others would fail the same
+			baker.mu.Lock()
+			baker.noFFmpeg = time.Now()
+			skipped := len(baker.queue) + 1
+			baker.queue = baker.queue[:0]
+			clear(baker.jobs)
+			baker.mu.Unlock()
+			logInfo("Skipped baking metadata of", skipped, "files for", BAKE_NO_FFMPEG_RETRY, err)
+			continue
+		}
+		if err != nil {
+			logWarn("Failed to bake metadata of", key, err)
+		} else {
+			logDebug("Baked metadata of", key)
+		}
+		baker.record(job, result, err)
+
+	}
+
+}
+
+func (baker *MetadataBaker) bake(job bakeJob) (bakeResult, error) {
+
+	var result bakeResult
+
+	fullpath := filepath.Join(job.dir, job.base)
+	metapath := filepath.Join(gAppInfo.MetadataDir, fullpath)
+
+	info, err := ioStat(fullpath)
+	if err != nil {
+		return result, err
+	}
+	if !info.ModTime().Equal(job.modTime) {
+		return result, fmt.Errorf("File is modified while queued")
+	}
+
+	devNull, err := ioOpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return result, err
+	}
+	defer devNull.Close()
+
+	for _, cmd := range gBakeCommands {
+
+		if !cmd.eligible(job.mimeType) {
+			continue
+		}
+
+		// Made by the uploading browser, ffprobe json of the old command is made again
+		outpath := metapath + cmd.OutputExt
+		if !job.force && fileNotEmpty(outpath) && !(cmd.OutputExt == META_EXT_TXT && mediaInfoOutdated(outpath)) {
+			continue
+		}
+
+		args := make([]string, len(cmd.Args))
+		copy(args, cmd.Args)
+		args[cmd.Input] = fullpath
+		args[cmd.Output] = outpath
+
+		err = executeFFmpeg(args, devNull, devNull)
+		if err == nil && !fileNotEmpty(outpath) {
+			err = fmt.Errorf("%s is not created", cmd.OutputExt)
+		}
+		if err != nil {
+			ioRemove(outpath) // empty one left by ffprobe -o
+			if cmd.Required {
+				return result, err
+			}
+			// e.g. audio without artwork
+			logDebug("Optional metadata of", fullpath, "is not baked", err)
+		}
+
+	}
+
+	data, err := ioReadFile(metapath + META_EXT_TXT)
+	if err != nil {
+		return result, err
+	}
+	result.Media, err = parseMediaInfo(data)
+	if err != nil {
+		return result, err
+	}
+
+	// Sprite sheet is optional, not for audio only ones e.g. podcasts in mp4
+	if isVideo(job.mimeType) {
+		if result.Media.VideoCodec == "" {
+			return result, nil
+		}
+		result.Sprite, err = bakeSprite(fullpath, metapath + META_EXT_SPRITE, result.Media)
+		if errors.Is(err, errNoNativeFFmpeg) {
+			return result, err
+		} else if err != nil {
+			logWarn("Failed to make sprite sheet of", fullpath, err)
+		}
+		return result, nil
+	}
+
+	if !isAudio(job.mimeType) {
+		return result, nil
+	}
+	// Analyses are optional, nil loudness for silence
+	result.Loudness, err = analyzeLoudness(fullpath)
+	if errors.Is(err, errNoNativeFFmpeg) {
+		return result, err
+	} else if err != nil {
+		logWarn("Failed to analyze loudness of", fullpath, err)
+	}
+	result.Waveform, err = bakeWaveform(fullpath, metapath + META_EXT_WAVEFORM, result.Media)
+	if errors.Is(err, errNoNativeFFmpeg) {
+		return result, err
+	} else if err != nil {
+		logWarn("Failed to make waveform of", fullpath, err)
+	}
+
+	return result, nil
+
+}
+
+func (baker *MetadataBaker) record(job bakeJob, result bakeResult, err error) {
+
+	cache, ok := baker.mgr.getCache(job.dir)
+	if !ok {
+		return
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	// Modified ones are queued again
+	meta, ok := cache.body.MetaMap[job.base]
+	if !ok || !meta.ModTime.Equal(job.modTime) {
+		return
+	}
+
+	meta.Media = result.Media
+	meta.Loudness = result.Loudness
+	meta.Sprite = result.Sprite
+	meta.Waveform = result.Waveform
+	meta.Display = nil
+	if err == nil && isHEIF(job.mimeType) {
+		meta.Display = newMetadataDisplay(job.dir, job.base)
+	}
+	meta.Bake = &MetadataBake{
+		ModTime:	job.modTime,
+		Version:	BAKE_VERSION,
+	}
+	if err != nil {
+		meta.Bake.Error = err.Error()
+	}
+
+	// Album gain of the others follows
+	bases := append(cache.updateAlbumGain(), job.base)
+	cache.save(false, bases...)
+
+	gEventHub.Publish(Event{
+		Type:		EVENT_BAKE,
+		Album:		getAlbumOfDir(cache.dir),
+		Bases:		[]string{job.base},
+		Error:		meta.Bake.Error,
+	})
+
+}
+
+func fileNotEmpty(path string) bool {
+	info, err := ioStat(path)
+	return err == nil && info.Size() > 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBakeOutdated(t *testing.T) {
+
+	audio := &MediaInfo{AudioCodec: "mp3"}
+	video := &MediaInfo{AudioCodec: "aac", VideoCodec: "h264"}
+
+	tests := []struct {
+		name	string
+		meta	Metadata
+		want	bool
+	}{
+		{"current", Metadata{MimeType: "audio/mpeg", Bake: &MetadataBake{Version: BAKE_VERSION}}, false},
+		{"current failed", Metadata{MimeType: "audio/mpeg", Bake: &MetadataBake{Version: BAKE_VERSION, Error: "x"}}, false},
+		{"old failed", Metadata{MimeType: "image/jpeg", Bake: &MetadataBake{Version: 1, Error: "x"}}, true},
+		{"no media", Metadata{MimeType: "image/webp", Bake: &MetadataBake{}}, true},
+		{"media without streams", Metadata{MimeType: "image/webp", Media: &MediaInfo{Duration: 1}, Bake: &MetadataBake{Version: 1}}, true},
+		{"webp", Metadata{MimeType: "image/webp", Media: video, Bake: &MetadataBake{}}, false},
+		{"no loudness", Metadata{MimeType: "audio/mpeg", Media: audio, Waveform: &MetadataWaveform{}, Bake: &MetadataBake{}}, true},
+		// Silence has no loudness
+		{"no loudness after its version", Metadata{MimeType: "audio/mpeg", Media: audio, Waveform: &MetadataWaveform{}, Bake: &MetadataBake{Version: 1}}, false},
+		{"no waveform", Metadata{MimeType: "audio/mpeg", Media: audio, Loudness: &MetadataLoudness{}, Bake: &MetadataBake{Version: 1}}, true},
+		{"audio", Metadata{MimeType: "audio/mpeg", Media: audio, Loudness: &MetadataLoudness{}, Waveform: &MetadataWaveform{}, Bake: &MetadataBake{}}, false},
+		{"no sprite", Metadata{MimeType: "video/mp4", Media: video, Bake: &MetadataBake{Version: 1}}, true},
+		{"audio only video", Metadata{MimeType: "video/mp4", Media: audio, Bake: &MetadataBake{Version: 1}}, false},
+		{"no display", Metadata{MimeType: MIME_HEIC, Media: video, Bake: &MetadataBake{Version: 1}}, true},
+		{"heic", Metadata{MimeType: MIME_HEIC, Media: video, Display: &MetadataDisplay{}, Bake: &MetadataBake{Version: 1}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.meta.bakeOutdated(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+}
+
+func TestBakerSkipsWithoutFFmpeg(t *testing.T) {
+
+	baker := NewMetadataBaker(nil, 0)
+	job := bakeJob{dir: "a", base: "x.mp3", mimeType: "audio/mpeg"}
+
+	baker.enqueue(job)
+	if len(baker.queue) != 1 {
+		t.Fatalf("queue %v, want 1 job", baker.queue)
+	}
+
+	baker.noFFmpeg = time.Now()
+	baker.enqueue(bakeJob{dir: "a", base: "y.mp3", mimeType: "audio/mpeg"})
+	if len(baker.queue) != 1 {
+		t.Errorf("queue %v, want no more jobs without ffmpeg", baker.queue)
+	}
+
+	baker.noFFmpeg = time.Now().Add(-BAKE_NO_FFMPEG_RETRY)
+	baker.enqueue(bakeJob{dir: "a", base: "y.mp3", mimeType: "audio/mpeg"})
+	if len(baker.queue) != 2 {
+		t.Errorf("queue %v, want the job queued after the while", baker.queue)
+	}
+
+}
@@ -6,7 +6,11 @@
 #  -s    disable symbol table
 #  -w    disable DWARF generation
 
+# CGO_CFLAGS
+#  musl 1.2.4+ dropped the *64 aliases go-sqlite3 refers to
+
 CC=i686-linux-musl-gcc CGO_ENABLED=1 GOOS=linux GOARCH=386 \
+    CGO_CFLAGS="-D_LARGEFILE64_SOURCE -Dpread64=pread -Dpwrite64=pwrite -Doff64_t=off_t" \
     go build -ldflags="-s -w -linkmode external -extldflags '-static' \
     -checklinkname=0" \
     -o bin/pocketserver_ish
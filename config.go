@@ -27,6 +27,8 @@ func parseFlag() {
 	debug := flag.Bool("debug", false, "Enable debug mode")
 	debug2 := flag.String("d", "_DISABLED_", "Enable debug channels, * for all debug channels")
 	password := flag.String("password", "", "Session password; when empty randomly generated")
+	metadataStore := flag.String(
+		"metadata-store", METADATA_STORE_JSON, "Metadata store, json or sqlite; json caches are migrated to sqlite once")
 	test := flag.String("T", "", "Test options")
 	testVar := flag.String("Tv", "", "Test var")
 
@@ -42,6 +44,7 @@ func parseFlag() {
 
 	//
 	gAppInfo.TermSpawner = *termSpawner
+	gAppInfo.MetadataStore = *metadataStore
 	
 	//
 	gAppInfo.Test = *test
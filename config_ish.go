@@ -12,6 +12,10 @@ import (
 const PERF_HTTP_MAX_CONCURRENT = 15
 const PERF_HTTP_TIMEOUT = time.Second * 30
 const PERF_FFMPEG_MAX_CONCURRENT = 1
+const PERF_FFMPEG_INTERACTIVE_MAX_CONCURRENT = 1
+const PERF_RESIZE_MAX_CONCURRENT = 1
+const PERF_CACHE_MAX_SIZE = 2 * 1024 * 1024 * 1024
+const PERF_HLS_REENCODE = false // libx264 takes hours
 
 const IO_EACH_CACHE_COOLDOWN = time.Second * 5
 
@@ -11,5 +11,9 @@ import (
 const PERF_HTTP_MAX_CONCURRENT = 20000
 const PERF_HTTP_TIMEOUT = time.Second * 30
 const PERF_FFMPEG_MAX_CONCURRENT = 30
+const PERF_FFMPEG_INTERACTIVE_MAX_CONCURRENT = 30
+const PERF_RESIZE_MAX_CONCURRENT = 4
+const PERF_CACHE_MAX_SIZE = 20 * 1024 * 1024 * 1024
+const PERF_HLS_REENCODE = true
 
 const IO_EACH_CACHE_COOLDOWN = time.Second * 2
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Delta of a cache
+//
+// Every save gives the cache a new version which is the ETag of /list.
+// GET /list?album=A&since=V returns the entries changed after V,
+// or the whole body when V is unknown e.g. after restarts.
+
+const QUERY_SINCE = "since"
+const META_TOMBSTONE_LIMIT = 1024
+
+type MetadataDelta struct {
+	Version		uint64			`json:"version"`
+	Changed		MetadataMap		`json:"changed"`
+	Removed		[]string		`json:"removed"`
+	Playlist	[]string		`json:"playlist"` // null when not changed
+	Playlists	[]*Playlist		`json:"playlists"` // null when not changed
+}
+
+// bumpVersion must be called while holding cache.bodyMu
+func (cache *metadataCache) bumpVersion(playlist bool, bases []string) {
+
+	cache.version = cache.mgr.version.Add(1)
+
+	for _, base := range bases {
+		if _, ok := cache.body.MetaMap[base]; ok {
+			cache.versions[base] = cache.version
+			delete(cache.removed, base)
+		} else {
+			cache.removed[base] = cache.version
+			delete(cache.versions, base)
+		}
+	}
+	if playlist {
+		cache.playlistVersion = cache.version
+	}
+
+	// Forget removals, older deltas become full
+	if len(cache.removed) > META_TOMBSTONE_LIMIT {
+		cache.removed = make(map[string]uint64)
+		cache.minVersion = cache.version
+	}
+
+}
+
+// Delta returns the json of MetadataDelta, false when the delta since the version is not known
+func (mgr *MetadataManager) Delta(dir string, since uint64) ([]byte, bool) {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return nil, false
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	if since < cache.minVersion || since > cache.version {
+		return nil, false
+	}
+
+	delta := &MetadataDelta{
+		Version:	cache.version,
+		Changed:	make(MetadataMap),
+		Removed:	make([]string, 0),
+	}
+	for base, version := range cache.versions {
+		if version > since {
+			delta.Changed[base] = cache.body.MetaMap[base]
+		}
+	}
+	for base, version := range cache.removed {
+		if version > since {
+			delta.Removed = append(delta.Removed, base)
+		}
+	}
+	if cache.playlistVersion > since {
+		delta.Playlist = cache.body.Playlist
+		delta.Playlists = cache.body.Playlists
+	}
+
+	// Entries are modified in place
+	data, err := json.Marshal(delta)
+	must(err)
+
+	return data, true
+
+}
+
+func formatVersionEtag(version uint64) string {
+	return "\"" + strconv.FormatUint(version, 10) + "\""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+
+	tests := []struct {
+		header	string
+		want	bool
+	}{
+		{``, false},
+		{`"12"`, true},
+		{`"1"`, false},
+		{`"123"`, false},
+		{`"1", "12"`, true},
+		{`"1","12" ,"3"`, true},
+		{`W/"12"`, true},
+		{`"112", "121"`, false},
+		{`*`, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/list", nil)
+		if tt.header != "" {
+			r.Header.Set("If-None-Match", tt.header)
+		}
+		if got := etagMatches(r, `"12"`); got != tt.want {
+			t.Errorf("%s got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+}
+
+func parseDelta(t *testing.T, data []byte) *MetadataDelta {
+
+	t.Helper()
+	delta := &MetadataDelta{}
+	if err := json.Unmarshal(data, delta); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(delta.Removed)
+
+	return delta
+
+}
+
+func TestDeltaSince(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dir := addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a", "y.mp3")
+	_, since, _ := gMetadataManager.Get(dir)
+
+	must(gMetadataManager.RemoveFile(dir, "y.mp3"))
+	addTestFile(t, "a", "z.mp3")
+	// Removed and added again
+	must(gMetadataManager.RemoveFile(dir, "x.mp3"))
+	addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a", "w.mp3")
+	must(gMetadataManager.RemoveFile(dir, "w.mp3"))
+	_, version, _ := gMetadataManager.Get(dir)
+
+	data, ok := gMetadataManager.Delta(dir, since)
+	if !ok {
+		t.Fatal("no delta")
+	}
+	delta := parseDelta(t, data)
+	if delta.Version != version || len(delta.Changed) != 2 || delta.Changed["x.mp3"] == nil || delta.Changed["z.mp3"] == nil {
+		t.Errorf("delta %+v", delta)
+	}
+	if want := []string{"w.mp3", "y.mp3"}; !slices.Equal(delta.Removed, want) {
+		t.Errorf("removed %v, want %v", delta.Removed, want)
+	}
+	// Removals of files change the playlist too
+	if delta.Playlist == nil {
+		t.Error("no playlist")
+	}
+
+	data, ok = gMetadataManager.Delta(dir, version)
+	if delta := parseDelta(t, data); !ok || len(delta.Changed) != 0 || len(delta.Removed) != 0 || delta.Playlist != nil {
+		t.Errorf("delta since the current %s", data)
+	}
+	if _, ok := gMetadataManager.Delta(dir, version + 1); ok {
+		t.Error("delta since a future version")
+	}
+
+}
+
+func TestDeltaTombstoneLimit(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dir := addTestFile(t, "a", "x.mp3")
+	_, since, _ := gMetadataManager.Get(dir)
+	cache, _ := gMetadataManager.getCache(dir)
+
+	bump := func(from, to int) {
+		cache.bodyMu.Lock()
+		defer cache.bodyMu.Unlock()
+		for i := from; i < to; i++ {
+			cache.save(false, "gone" + strconv.Itoa(i))
+		}
+	}
+
+	bump(0, META_TOMBSTONE_LIMIT)
+	if data, ok := gMetadataManager.Delta(dir, since); !ok || len(parseDelta(t, data).Removed) != META_TOMBSTONE_LIMIT {
+		t.Fatal("delta within the limit is not known")
+	}
+
+	bump(META_TOMBSTONE_LIMIT, META_TOMBSTONE_LIMIT + 1)
+	if _, ok := gMetadataManager.Delta(dir, since); ok {
+		t.Error("delta over the limit is known")
+	}
+	_, version, _ := gMetadataManager.Get(dir)
+	if _, ok := gMetadataManager.Delta(dir, version); !ok {
+		t.Error("delta since the current version is not known")
+	}
+
+	// Whole body for the unknown
+	r := httptest.NewRequest(http.MethodGet, "/list?album=a&cache&since=" + strconv.FormatUint(since, 10), nil)
+	w := httptest.NewRecorder()
+	listHandler(w, r)
+	body := &MetadataBody{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil || body.MetaMap["x.mp3"] == nil {
+		t.Errorf("got %s", w.Body.String())
+	}
+
+}
+
+func TestListHandlerNotModified(t *testing.T) {
+
+	newTestMetadataManager(t)
+	addTestFile(t, "a", "x.mp3")
+
+	get := func(match string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/list?album=a&cache", nil)
+		if match != "" {
+			r.Header.Set("If-None-Match", match)
+		}
+		w := httptest.NewRecorder()
+		listHandler(w, r)
+		return w
+	}
+
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d etag %q", w.Code, etag)
+	}
+	if w := get(`"0", ` + etag); w.Code != http.StatusNotModified {
+		t.Errorf("listed etag status %d", w.Code)
+	}
+	// Not a substring match
+	if w := get(`"1` + etag[1:]); w.Code != http.StatusOK {
+		t.Errorf("other etag status %d", w.Code)
+	}
+
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Duplicate detection
+//
+// GET /api/duplicates?crc=C&size=N lists the files of the same content across albums
+// Uploads with ?duplicate=skip do not store a file that already exists and
+// ?duplicate=link hard-links the existing file into the album instead
+
+const QUERY_CRC = "crc"
+const QUERY_SIZE = "size"
+const QUERY_DUPLICATE = "duplicate"
+const DUPLICATE_SKIP = "skip"
+const DUPLICATE_LINK = "link"
+
+type DuplicateResult struct {
+	Action		string				`json:"action"`
+	Base		string				`json:"base"`
+	Duplicate	MetadataLocation	`json:"duplicate"`
+}
+
+// findDuplicateAction decides what to do with an upload to dir, empty action means upload as usual
+func findDuplicateAction(mode, dir string, size int64, crc string) (string, MetadataLocation) {
+
+	if mode != DUPLICATE_SKIP && mode != DUPLICATE_LINK {
+		return "", MetadataLocation{}
+	}
+
+	locs := gMetadataManager.FindByCrc(crc, size)
+	if len(locs) == 0 {
+		return "", MetadataLocation{}
+	}
+
+	// Linking within the same album would just make another name of it
+	for _, loc := range locs {
+		if loc.Dir == dir {
+			return DUPLICATE_SKIP, loc
+		}
+	}
+
+	return mode, locs[0]
+
+}
+
+// applyDuplicateAction links the duplicate as name in dir for link action
+func applyDuplicateAction(action, dir, name string, loc MetadataLocation) (DuplicateResult, error) {
+
+	result := DuplicateResult{
+		Action:		action,
+		Base:		loc.Base,
+		Duplicate:	loc,
+	}
+
+	if action != DUPLICATE_LINK {
+		return result, nil
+	}
+
+	base := recursiveNewName(dir, name)
+	fullpath := filepath.Join(dir, base)
+	err := os.Link(filepath.Join(loc.Dir, loc.Base), fullpath)
+	if err != nil {
+		return result, fmt.Errorf("Failed to link %s: %w", fullpath, err)
+	}
+	result.Base = base
+
+	// Metadata files of the same content are reusable
+	exts, err := getMetadataSidecars(loc.Dir, loc.Base)
+	if err != nil {
+		logWarn("Failed to read metadata of", loc.Base, err)
+	}
+	for _, ext := range exts {
+		err = os.Link(
+			filepath.Join(gAppInfo.MetadataDir, loc.Dir, loc.Base) + ext,
+			filepath.Join(gAppInfo.MetadataDir, dir, base) + ext,
+		)
+		if err != nil {
+			logWarn("Failed to link metadata of", base, ext, err)
+		}
+	}
+
+	info, err := ioStat(fullpath)
+	if err != nil {
+		return result, fmt.Errorf("Error doing stat of linked file: %w", err)
+	}
+
+	return result, gMetadataManager.SetMetadata(dir, base, info, loc.Crc32)
+
+}
+
+func apiDuplicates(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	crc := query.Get(QUERY_CRC)
+
+	var size int64
+	_, err := fmt.Sscan(query.Get(QUERY_SIZE), &size)
+	if err != nil || len(crc) != 8 {
+		logHTTPRequest(r, -1, "Malformed duplicate query", err)
+		http.Error(w, "Malformed query", http.StatusBadRequest)
+		return
+	}
+
+	serveJson(w, r, gMetadataManager.FindByCrc(crc, size))
+
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server-Sent Events
+//
+// GET /api/events                   streams the changes of the caches
+// GET /api/events?device=D&name=N    also registers the player D for remote control
+//
+//   event: metadata   entries of bases or the playlist of the album are changed to the version
+//   event: bake       metadata files of the base are baked
+//   event: playback   playback state of the album is set by the device
+//   event: command    remote command for the player D, see remote.go
+//
+// A subscriber that cannot keep up is disconnected so that it reconnects and lists again.
+
+const EVENT_METADATA = "metadata"
+const EVENT_BAKE = "bake"
+const EVENTS_BUFFER = 64
+const EVENTS_HEARTBEAT = time.Second * 25
+
+type Event struct {
+	Type		string		`json:"-"`
+	Album		string		`json:"album"`
+	Version		uint64		`json:"version,omitempty"`
+	Bases		[]string	`json:"bases,omitempty"`
+	Playlist	bool		`json:"playlist,omitempty"`
+	Error		string		`json:"error,omitempty"`
+	Device		string		`json:"device,omitempty"`
+	Listener	string		`json:"listener,omitempty"`
+}
+
+type EventHub struct {
+	subscribers		map[chan Event]struct{}
+	mu				sync.Mutex
+}
+
+var gEventHub = NewEventHub()
+
+func NewEventHub() *EventHub {
+
+	hub := &EventHub{}
+
+	hub.subscribers = make(map[chan Event]struct{})
+
+	return hub
+
+}
+
+func (hub *EventHub) Subscribe() chan Event {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ch := make(chan Event, EVENTS_BUFFER)
+	hub.subscribers[ch] = struct{}{}
+
+	return ch
+
+}
+
+func (hub *EventHub) Unsubscribe(ch chan Event) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if _, ok := hub.subscribers[ch]; ok {
+		delete(hub.subscribers, ch)
+		close(ch)
+	}
+
+}
+
+// Publish never blocks
+func (hub *EventHub) Publish(event Event) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(hub.subscribers, ch)
+			close(ch)
+		}
+	}
+
+}
+
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logHTTPRequest(r, -1, "Streaming is not supported")
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := gEventHub.Subscribe()
+	defer gEventHub.Unsubscribe(ch)
+
+	// Nil channel of commands for those not registered
+	var commands chan RemoteCommand
+	query := r.URL.Query()
+	if device := query.Get(QUERY_DEVICE); device != "" {
+		name := []rune(query.Get(QUERY_NAME))
+		if len(name) > REMOTE_NAME_LIMIT {
+			name = name[:REMOTE_NAME_LIMIT]
+		}
+		sess := gRemoteHub.Register(device, string(name))
+		defer gRemoteHub.Unregister(sess)
+		commands = sess.commands
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EVENTS_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-ch:
+			if !ok {
+				logHTTPRequest(r, -1, "Events dropped for slow subscriber")
+				return
+			}
+			data, err := json.Marshal(event)
+			must(err)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case cmd, ok := <-commands:
+			if !ok {
+				logHTTPRequest(r, -1, "Remote session replaced", query.Get(QUERY_DEVICE))
+				return
+			}
+			data, err := json.Marshal(cmd)
+			must(err)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EVENT_COMMAND, data)
+		}
+		flusher.Flush()
+	}
+
+}
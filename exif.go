@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF
+//
+// Capture time, camera, orientation and GPS are read in pure Go from JPEG APP1 segments,
+// TIFF-based files (TIFF, DNG and most raw formats) and the Exif item of HEIF, and kept
+// in Metadata.Exif. Only the head of the file is read so values pointing further are ignored.
+
+const EXIF_READ_LIMIT = 1 << 20
+const EXIF_TIME_LAYOUT = "2006:01:02 15:04:05"
+
+const EXIF_TAG_MAKE = 0x010f
+const EXIF_TAG_MODEL = 0x0110
+const EXIF_TAG_ORIENTATION = 0x0112
+const EXIF_TAG_DATETIME = 0x0132
+const EXIF_TAG_EXIF_IFD = 0x8769
+const EXIF_TAG_GPS_IFD = 0x8825
+const EXIF_TAG_DATETIME_ORIGINAL = 0x9003
+const EXIF_TAG_OFFSET_TIME_ORIGINAL = 0x9011
+const EXIF_TAG_GPS_LATITUDE_REF = 0x0001
+const EXIF_TAG_GPS_LATITUDE = 0x0002
+const EXIF_TAG_GPS_LONGITUDE_REF = 0x0003
+const EXIF_TAG_GPS_LONGITUDE = 0x0004
+const EXIF_TAG_GPS_ALTITUDE_REF = 0x0005
+const EXIF_TAG_GPS_ALTITUDE = 0x0006
+
+// Parsed once per change of the file, an empty one tells there is nothing
+type MetadataExif struct {
+	Taken		string		`json:"taken,omitempty"` // RFC 3339, without the offset when unknown
+	Make		string		`json:"make,omitempty"`
+	Model		string		`json:"model,omitempty"`
+	Orientation	int			`json:"orientation,omitempty"` // 1-8
+	GPS			*ExifGPS	`json:"gps,omitempty"`
+}
+
+type ExifGPS struct {
+	Latitude	float64		`json:"latitude"`
+	Longitude	float64		`json:"longitude"`
+	Altitude	*float64	`json:"altitude,omitempty"` // meters
+}
+
+var gExifTIFFMimeTypes = []string{
+	"image/tiff", "image/x-adobe-dng", "image/x-canon-cr2", "image/x-nikon-nef",
+	"image/x-sony-arw", "image/x-olympus-orf", "image/x-panasonic-rw2",
+}
+
+func hasExif(mimeType string) bool {
+	if mimeType == "image/jpeg" || isHEIF(mimeType) {
+		return true
+	}
+	for _, typ := range gExifTIFFMimeTypes {
+		if mimeType == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// readExif returns an empty one when the file has no EXIF
+func readExif(fullpath, mimeType string) (*MetadataExif, error) {
+
+	f, err := ioOpen(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, EXIF_READ_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+
+	var tiff []byte
+	switch {
+	case mimeType == "image/jpeg":
+		tiff = findJPEGExif(data)
+	case isHEIF(mimeType):
+		// Exif item is "Exif\0\0" followed by TIFF, wherever it is in the mdat
+		if i := bytes.Index(data, []byte("Exif\x00\x00")); i >= 0 {
+			tiff = data[i + 6:]
+		}
+	default:
+		tiff = data
+	}
+	if tiff == nil {
+		return &MetadataExif{}, nil
+	}
+
+	return parseTIFFExif(tiff)
+
+}
+
+// findJPEGExif returns the TIFF of the APP1 segment
+func findJPEGExif(data []byte) []byte {
+
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+
+	for i := 2; i + 4 <= len(data); {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i + 1]
+		if marker == 0xd8 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			i += 2
+			continue
+		}
+		// Start of scan, no more headers
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[i + 2:]))
+		end := i + 2 + size
+		if size < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[i + 4:end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+
+	return nil
+
+}
+
+type tiffReader struct {
+	data	[]byte
+	order	binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ		uint16
+	count	uint32
+	value	[]byte
+}
+
+var gTIFFTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8,
+}
+
+// ifd returns the entries of the IFD at offset by tag
+func (tr *tiffReader) ifd(offset uint32) (map[uint16]tiffEntry, error) {
+
+	if int64(offset) + 2 > int64(len(tr.data)) {
+		return nil, fmt.Errorf("IFD out of range %d", offset)
+	}
+
+	n := int(tr.order.Uint16(tr.data[offset:]))
+	entries := make(map[uint16]tiffEntry)
+	for i := 0; i < n; i++ {
+		at := int(offset) + 2 + i * 12
+		if at + 12 > len(tr.data) {
+			break
+		}
+		tag := tr.order.Uint16(tr.data[at:])
+		typ := tr.order.Uint16(tr.data[at + 2:])
+		count := tr.order.Uint32(tr.data[at + 4:])
+		unit, ok := gTIFFTypeSizes[typ]
+		if !ok {
+			continue
+		}
+		size := int64(unit) * int64(count)
+		value := tr.data[at + 8:at + 12]
+		if size > 4 {
+			valueOffset := int64(tr.order.Uint32(value))
+			if valueOffset + size > int64(len(tr.data)) {
+				continue
+			}
+			value = tr.data[valueOffset:valueOffset + size]
+		} else {
+			value = value[:size]
+		}
+		entries[tag] = tiffEntry{typ, count, value}
+	}
+
+	return entries, nil
+
+}
+
+func (tr *tiffReader) str(entry tiffEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+}
+
+func (tr *tiffReader) uint(entry tiffEntry) (uint32, bool) {
+	switch {
+	case entry.typ == 3 && len(entry.value) >= 2:
+		return uint32(tr.order.Uint16(entry.value)), true
+	case entry.typ == 4 && len(entry.value) >= 4:
+		return tr.order.Uint32(entry.value), true
+	case entry.typ == 1 && len(entry.value) >= 1:
+		return uint32(entry.value[0]), true
+	}
+	return 0, false
+}
+
+func (tr *tiffReader) rationals(entry tiffEntry) []float64 {
+	if entry.typ != 5 {
+		return nil
+	}
+	values := make([]float64, 0, entry.count)
+	for i := 0; i + 8 <= len(entry.value); i += 8 {
+		num := tr.order.Uint32(entry.value[i:])
+		den := tr.order.Uint32(entry.value[i + 4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num) / float64(den))
+	}
+	return values
+}
+
+func parseTIFFExif(data []byte) (*MetadataExif, error) {
+
+	if len(data) < 8 {
+		return nil, fmt.Errorf("TIFF header is too short")
+	}
+
+	tr := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		tr.order = binary.LittleEndian
+	case "MM":
+		tr.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Unknown byte order %q", data[:2])
+	}
+	// 42, or others of raw formats e.g. ORF and RW2
+	ifd0, err := tr.ifd(tr.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &MetadataExif{}
+	exif.Make = tr.str(ifd0[EXIF_TAG_MAKE])
+	exif.Model = tr.str(ifd0[EXIF_TAG_MODEL])
+	if orientation, ok := tr.uint(ifd0[EXIF_TAG_ORIENTATION]); ok && orientation >= 1 && orientation <= 8 {
+		exif.Orientation = int(orientation)
+	}
+
+	// Capture time preferred to the modification
+	taken := tr.str(ifd0[EXIF_TAG_DATETIME])
+	offset := ""
+	if pointer, ok := tr.uint(ifd0[EXIF_TAG_EXIF_IFD]); ok {
+		if sub, err := tr.ifd(pointer); err == nil {
+			if original := tr.str(sub[EXIF_TAG_DATETIME_ORIGINAL]); original != "" {
+				taken = original
+				offset = tr.str(sub[EXIF_TAG_OFFSET_TIME_ORIGINAL])
+			}
+		}
+	}
+	exif.Taken = formatExifTime(taken, offset)
+
+	if pointer, ok := tr.uint(ifd0[EXIF_TAG_GPS_IFD]); ok {
+		if gps, err := tr.ifd(pointer); err == nil {
+			exif.GPS = parseExifGPS(tr, gps)
+		}
+	}
+
+	return exif, nil
+
+}
+
+// formatExifTime returns "" for unknown, e.g. "0000:00:00 00:00:00"
+func formatExifTime(value, offset string) string {
+
+	t, err := time.Parse(EXIF_TIME_LAYOUT, value)
+	if err != nil || t.Year() < 1800 {
+		return ""
+	}
+
+	if zone, err := time.Parse("-07:00", offset); err == nil {
+		_, seconds := zone.Zone()
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0,
+			time.FixedZone("", seconds)).Format(time.RFC3339)
+	}
+
+	return t.Format("2006-01-02T15:04:05")
+
+}
+
+func parseExifGPS(tr *tiffReader, gps map[uint16]tiffEntry) *ExifGPS {
+
+	degrees := func(values []float64) (float64, bool) {
+		if len(values) != 3 {
+			return 0, false
+		}
+		return values[0] + values[1] / 60 + values[2] / 3600, true
+	}
+
+	lat, ok1 := degrees(tr.rationals(gps[EXIF_TAG_GPS_LATITUDE]))
+	lon, ok2 := degrees(tr.rationals(gps[EXIF_TAG_GPS_LONGITUDE]))
+	if !ok1 || !ok2 || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return nil
+	}
+	if tr.str(gps[EXIF_TAG_GPS_LATITUDE_REF]) == "S" {
+		lat = -lat
+	}
+	if tr.str(gps[EXIF_TAG_GPS_LONGITUDE_REF]) == "W" {
+		lon = -lon
+	}
+
+	result := &ExifGPS{Latitude: lat, Longitude: lon}
+	if values := tr.rationals(gps[EXIF_TAG_GPS_ALTITUDE]); len(values) == 1 {
+		altitude := values[0]
+		// 1 is below sea level
+		if ref, ok := tr.uint(gps[EXIF_TAG_GPS_ALTITUDE_REF]); ok && ref == 1 {
+			altitude = -altitude
+		}
+		result.Altitude = &altitude
+	}
+
+	return result
+
+}
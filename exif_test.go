@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+type testTIFFTag struct {
+	tag		uint16
+	typ		uint16
+	count	uint32
+	value	[]byte
+}
+
+func testASCII(tag uint16, s string) testTIFFTag {
+	return testTIFFTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func testShort(order binary.ByteOrder, tag uint16, v uint16) testTIFFTag {
+	value := make([]byte, 2)
+	order.PutUint16(value, v)
+	return testTIFFTag{tag, 3, 1, value}
+}
+
+// testTIFF lays out IFD0 at 8, the Exif IFD after it when given, then the values longer than 4 bytes
+func testTIFF(order binary.ByteOrder, ifd0, sub []testTIFFTag) []byte {
+
+	if len(sub) > 0 {
+		ifd0 = append(ifd0, testTIFFTag{EXIF_TAG_EXIF_IFD, 4, 1, nil})
+	}
+	subAt := 8 + 2 + 12 * len(ifd0) + 4
+	dataAt := subAt + 2 + 12 * len(sub) + 4
+
+	buf := make([]byte, dataAt)
+	if order == binary.LittleEndian {
+		copy(buf, "II")
+	} else {
+		copy(buf, "MM")
+	}
+	order.PutUint16(buf[2:], 42)
+	order.PutUint32(buf[4:], 8)
+
+	var data []byte
+	write := func(at int, tags []testTIFFTag) {
+		order.PutUint16(buf[at:], uint16(len(tags)))
+		for i, tag := range tags {
+			e := at + 2 + i * 12
+			order.PutUint16(buf[e:], tag.tag)
+			order.PutUint16(buf[e + 2:], tag.typ)
+			order.PutUint32(buf[e + 4:], tag.count)
+			value := tag.value
+			if value == nil {
+				value = make([]byte, 4)
+				order.PutUint32(value, uint32(subAt))
+			}
+			if len(value) > 4 {
+				order.PutUint32(buf[e + 8:], uint32(dataAt + len(data)))
+				data = append(data, value...)
+			} else {
+				copy(buf[e + 8:], value)
+			}
+		}
+	}
+	write(8, ifd0)
+	if len(sub) > 0 {
+		write(subAt, sub)
+	}
+
+	return append(buf, data...)
+
+}
+
+func TestParseTIFFExif(t *testing.T) {
+
+	le, be := binary.LittleEndian, binary.BigEndian
+	tests := []struct {
+		name	string
+		data	[]byte
+		want	MetadataExif
+		err		bool
+	}{
+		{"too short", []byte("II*\x00"), MetadataExif{}, true},
+		{"unknown byte order", []byte("XX*\x00\x08\x00\x00\x00\x00\x00"), MetadataExif{}, true},
+		{"IFD out of range", []byte("II*\x00\xff\x00\x00\x00"), MetadataExif{}, true},
+		{
+			"little endian",
+			testTIFF(le, []testTIFFTag{
+				testASCII(EXIF_TAG_MAKE, "Apple"),
+				testASCII(EXIF_TAG_MODEL, "iPhone 15 Pro"),
+				testShort(le, EXIF_TAG_ORIENTATION, 6),
+				testASCII(EXIF_TAG_DATETIME, "2024:05:02 10:00:00"),
+			}, []testTIFFTag{
+				testASCII(EXIF_TAG_DATETIME_ORIGINAL, "2024:05:01 09:30:15"),
+				testASCII(EXIF_TAG_OFFSET_TIME_ORIGINAL, "+09:00"),
+			}),
+			MetadataExif{Taken: "2024-05-01T09:30:15+09:00", Make: "Apple", Model: "iPhone 15 Pro", Orientation: 6},
+			false,
+		},
+		{
+			"big endian without offset",
+			testTIFF(be, []testTIFFTag{
+				testASCII(EXIF_TAG_MAKE, "Canon "),
+				testShort(be, EXIF_TAG_ORIENTATION, 1),
+			}, []testTIFFTag{
+				testASCII(EXIF_TAG_DATETIME_ORIGINAL, "2019:12:31 23:59:59"),
+			}),
+			MetadataExif{Taken: "2019-12-31T23:59:59", Make: "Canon", Orientation: 1},
+			false,
+		},
+		{
+			"modification time without Exif IFD",
+			testTIFF(le, []testTIFFTag{
+				testASCII(EXIF_TAG_DATETIME, "2020:01:02 03:04:05"),
+			}, nil),
+			MetadataExif{Taken: "2020-01-02T03:04:05"},
+			false,
+		},
+		{
+			"unknown time and invalid orientation",
+			testTIFF(le, []testTIFFTag{
+				testASCII(EXIF_TAG_DATETIME, "0000:00:00 00:00:00"),
+				testShort(le, EXIF_TAG_ORIENTATION, 9),
+			}, nil),
+			MetadataExif{},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTIFFExif(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("want error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GPS != nil {
+				t.Errorf("GPS = %+v, want nil", got.GPS)
+			}
+			got.GPS = nil
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+}
+
+func TestFindJPEGExif(t *testing.T) {
+
+	tiff := testTIFF(binary.LittleEndian, []testTIFFTag{testASCII(EXIF_TAG_MAKE, "Apple")}, nil)
+	segment := func(marker byte, payload []byte) []byte {
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(payload) + 2))
+		return append(append([]byte{0xff, marker}, size...), payload...)
+	}
+	jpeg := func(segments ...[]byte) []byte {
+		data := []byte{0xff, 0xd8}
+		for _, s := range segments {
+			data = append(data, s...)
+		}
+		return data
+	}
+	app1 := segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))
+
+	tests := []struct {
+		name	string
+		data	[]byte
+		want	[]byte
+	}{
+		{"empty", nil, nil},
+		{"not a JPEG", append([]byte("\x89PNG"), app1...), nil},
+		{"first segment", jpeg(app1), tiff},
+		{"after JFIF", jpeg(segment(0xe0, []byte("JFIF\x00\x01\x02")), app1), tiff},
+		{"after XMP", jpeg(segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00")), app1), tiff},
+		{"after start of scan", jpeg(segment(0xda, []byte{0, 0}), app1), nil},
+		{"truncated", jpeg(app1[:len(app1) - 1]), nil},
+		{"no Exif", jpeg(segment(0xe0, []byte("JFIF\x00"))), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findJPEGExif(tt.data)
+			if string(got) != string(tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+}
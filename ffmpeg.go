@@ -47,12 +47,34 @@ func initFFmpegSocket() {
 	ffmpegHandler = makeFFmpegHandler()
 }
 
+// Requests being waited for by a client have their own slots so that they don't wait behind bakes
 var ffmpegSempahore = NewSemaphore(PERF_FFMPEG_MAX_CONCURRENT, 0)
-// Find the native ffmpeg and run it
+var ffmpegInteractiveSemaphore = NewSemaphore(PERF_FFMPEG_INTERACTIVE_MAX_CONCURRENT, 0)
+var errNoNativeFFmpeg = errors.New("No native ffmpeg is found")
+var errFFmpegExit = errors.New("ffmpeg exited with status")
+// Find the native ffmpeg and run it in a background slot
 func executeFFmpeg(args []string, stdout, stderr *ioFile) (error) {
 
 	ffmpegSempahore.Acquire()
 	defer ffmpegSempahore.Release()
+
+	return runFFmpeg(args, stdout, stderr)
+
+}
+
+// executeFFmpegInteractive runs the native ffmpeg for a request being waited for
+func executeFFmpegInteractive(args []string, stdout, stderr *ioFile) (error) {
+
+	ffmpegInteractiveSemaphore.Acquire()
+	defer ffmpegInteractiveSemaphore.Release()
+
+	return runFFmpeg(args, stdout, stderr)
+
+}
+
+// runFFmpeg must be limited by the caller
+func runFFmpeg(args []string, stdout, stderr *ioFile) (error) {
+
 	defer logDebug2('f', "d", 10)
 
 	logDebug2('f', 10)
@@ -63,7 +85,7 @@ func executeFFmpeg(args []string, stdout, stderr *ioFile) (error) {
 	logDebug2('f', 20)
 	native, ok := nativeFFs[arg0]
 	if !ok || err != nil {
-		return fmt.Errorf("No native ffmpeg is found err: %w", err)
+		return fmt.Errorf("%w err: %v", errNoNativeFFmpeg, err)
 	}
 	args[0] = native
 	if arg0 == "ffmpeg" {
@@ -111,9 +133,12 @@ func executeFFmpeg(args []string, stdout, stderr *ioFile) (error) {
 		return fmt.Errorf("Failed to start ffmpeg process: %w", err)
 	}
 
-	<-wait
-	
+	status := <-wait
+
 	logDebug2('f', 50)
+	if status != 0 {
+		return fmt.Errorf("%w %d", errFFmpegExit, status)
+	}
 	return nil
 
 }
@@ -588,7 +613,7 @@ func writeFFmpegMessageOfType(wsConn *websocket.Conn, typ string, val interface{
 	}
 	msg, err := json.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("Json marshal error %w: %w", err, data)
+		return fmt.Errorf("Json marshal error %w: %v", err, data)
 	}
 	err = wsConn.WriteMessage(websocket.TextMessage, msg)
 	if err != nil {
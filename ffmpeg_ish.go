@@ -15,7 +15,7 @@ import (
 	"fmt"
 )
 
-func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan struct{}, func() error, error) {
+func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan int, func() error, error) {
 
 	cStdout := C.int(-1)
 	cStderr := C.int(-1)
@@ -53,12 +53,13 @@ func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan struct{}, fun
 	}
 	logDebug2('f', 30)
 
-	wait := make(chan struct{})
+	// Exit status, 128 + signal when killed
+	wait := make(chan int, 1)
 	go func() {
 		logDebug2('f', 40)
-		C.wait_process(pid)
+		status := C.wait_process(pid)
 		logDebug2('f', 50)
-		wait <-struct{}{}
+		wait <-int(status)
 		logDebug2('f', 60)
 	}()
 
@@ -69,8 +70,7 @@ func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan struct{}, fun
 		}
 		return nil
 	}
-	
-	// TODO process exit code error handling
+
 	return wait, terminator, nil
 }
 
@@ -9,7 +9,7 @@ import (
 	"runtime"
 )
 
-func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan struct{}, func() error, error) {
+func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan int, func() error, error) {
 
 	command := joinCommandArgs(args)
 	var cmd *exec.Cmd
@@ -29,10 +29,11 @@ func _executeFFmpeg(args []string, stdout, stderr *ioFile) (<-chan struct{}, fun
 		return nil, nil, fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
-	wait := make(chan struct{})
+	// Exit status, -1 when killed by a signal
+	wait := make(chan int, 1)
 	go func() {
 		cmd.Wait()
-		wait <-struct{}{}
+		wait <-cmd.ProcessState.ExitCode()
 	}()
 	return wait, cmd.Process.Kill, nil
 
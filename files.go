@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+)
+
+// File operations
+//
+// DELETE /api/files?album=A&name=F                      deletes F in A
+// POST   /api/files?album=A&name=F&op=move&to=B[&as=G]  moves F in A to B as G
+// POST   /api/files?album=A&name=F&op=copy&to=B[&as=G]  copies F in A to B as G
+//
+// Metadata files and the entries of the caches and playlists follow the file
+
+const QUERY_OP = "op"
+const QUERY_TO = "to"
+const QUERY_AS = "as"
+const FILE_OP_MOVE = "move"
+const FILE_OP_COPY = "copy"
+
+func validateFileName(name string) error {
+
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return fmt.Errorf("Invalid file name %q", name)
+	}
+
+	return nil
+
+}
+
+func apiFiles(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	dir, err := getAlbumDir(query.Get(QUERY_ALBUM))
+	if err != nil {
+		logHTTPRequest(r, -1, "getAlbumDir err:", err)
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+	base := query.Get(QUERY_NAME)
+	if err := validateFileName(base); err != nil {
+		logHTTPRequest(r, -1, "validateFileName err:", err)
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+
+		err = gMetadataManager.RemoveFile(dir, base)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to remove file err:", err)
+			http.Error(w, "Failed to remove file", http.StatusBadRequest)
+			return
+		}
+
+		logHTTPRequest(r, -1, "FILE DELETED", dir, base)
+
+	case http.MethodPost:
+
+		op := query.Get(QUERY_OP)
+		if op != FILE_OP_MOVE && op != FILE_OP_COPY {
+			logHTTPRequest(r, -1, "Invalid file op:", op)
+			http.Error(w, "Invalid file operation", http.StatusBadRequest)
+			return
+		}
+
+		newDir := dir
+		if query.Has(QUERY_TO) {
+			newDir, err = getAlbumDir(query.Get(QUERY_TO))
+			if err != nil {
+				logHTTPRequest(r, -1, "getAlbumDir err:", err)
+				http.Error(w, "Invalid album", http.StatusBadRequest)
+				return
+			}
+		}
+		newBase := base
+		if query.Has(QUERY_AS) {
+			newBase = query.Get(QUERY_AS)
+			if err := validateFileName(newBase); err != nil {
+				logHTTPRequest(r, -1, "validateFileName err:", err)
+				http.Error(w, "Invalid file name", http.StatusBadRequest)
+				return
+			}
+		}
+
+		newBase, err := gMetadataManager.MoveFile(dir, base, newDir, newBase, op == FILE_OP_COPY)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to", op, "file err:", err)
+			http.Error(w, "Failed to " + op + " file", http.StatusBadRequest)
+			return
+		}
+
+		logHTTPRequest(r, -1, "FILE", op, dir, base, newDir, newBase)
+		serveJson(w, r, map[string]string{
+			"album":	getAlbumOfDir(newDir),
+			"base":		newBase,
+		})
+
+	default:
+
+		logHTTPRequest(r, -1, "Invalid method for files")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+
+	}
+
+}
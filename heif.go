@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+)
+
+// HEIC/HEIF photos
+//
+// Photos from iPhones are detected by extension, or by the ftyp brand when the name tells nothing.
+// Since most browsers cannot render them, a JPEG of the same size and a webp thumbnail are baked
+// and recorded in Metadata.Display so that /list tells both the original and the derivatives:
+//
+// GET /view/B?album=A&metadata=_display.jpg  returns the JPEG derivative
+// GET /view/B?album=A&metadata=.webp         returns the thumbnail
+
+const MIME_HEIC = "image/heic"
+const MIME_HEIF = "image/heif"
+
+// Brands of the ftyp box
+var gHEIFBrands = map[string]string{
+	"heic": MIME_HEIC,
+	"heix": MIME_HEIC,
+	"heim": MIME_HEIC,
+	"heis": MIME_HEIC,
+	"hevc": MIME_HEIC,
+	"hevx": MIME_HEIC,
+	"mif1": MIME_HEIF,
+	"msf1": MIME_HEIF,
+}
+
+type MetadataDisplay struct {
+	MimeType	string		`json:"mimeType"`
+	Metadata	string		`json:"metadata"` // for QUERY_METADATA
+	Thumb		string		`json:"thumb,omitempty"`
+}
+
+func isHEIF(mimeType string) bool {
+	return mimeType == MIME_HEIC || mimeType == MIME_HEIF
+}
+
+// sniffHEIF returns the mime type of the file when it is HEIF, otherwise ""
+func sniffHEIF(fullpath string) string {
+
+	f, err := ioOpen(fullpath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// size(4) "ftyp" major_brand(4)
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil || string(head[4:8]) != "ftyp" {
+		return ""
+	}
+
+	return gHEIFBrands[string(head[8:12])]
+
+}
+
+// newMetadataDisplay returns the derivatives baked for the HEIF file, nil if there is none
+func newMetadataDisplay(dir, base string) *MetadataDisplay {
+
+	metapath := filepath.Join(gAppInfo.MetadataDir, dir, base)
+	if !fileNotEmpty(metapath + META_EXT_DISPLAY) {
+		return nil
+	}
+
+	display := &MetadataDisplay{
+		MimeType:	"image/jpeg",
+		Metadata:	META_EXT_DISPLAY,
+	}
+	if fileNotEmpty(metapath + META_EXT_THUMB) {
+		display.Thumb = META_EXT_THUMB
+	}
+
+	return display
+
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS packaging
+//
+// GET /hls/<album>/<file>/index.m3u8 returns the playlist of the video, packaging it in the background
+// GET /hls/<album>/<file>/<segment>  returns init.mp4 and seg_NNNNN.m4s
+//
+// Videos are segmented into fMP4 under MetadataDir/hls/CRC_SIZE by native ffmpeg, copying h264 and hevc
+// and re-encoding others unless PERF_HLS_REENCODE is off as on iSH. The playlist is an event playlist so that playback starts with the first
+// segments, it is complete when it has #EXT-X-ENDLIST.
+
+const URL_HLS = "/hls/"
+const HLS_DIR = "hls"
+const HLS_PLAYLIST = "index.m3u8"
+const HLS_INIT = "init.mp4"
+const HLS_SEGMENT_SECONDS = "6"
+const HLS_ENDLIST = "#EXT-X-ENDLIST"
+const HLS_WAIT = time.Second * 20
+const HLS_POLL = time.Millisecond * 250
+const HLS_MAX_CONCURRENT = 1
+const HLS_RETRY_AFTER = time.Minute * 10
+
+var gHLSSegmentRegex = regexp.MustCompile(`^(init\.mp4|seg_[0-9]{5}\.m4s)$`)
+
+type hlsJob struct {
+	done		chan struct{}
+	err			error
+	retry		time.Time // of failed ones, set while holding packager.mu
+}
+
+type HLSPackager struct {
+	jobs		map[string] *hlsJob // by key
+	mu			sync.Mutex
+	semaphore	*Semaphore
+}
+
+var gHLSPackager = NewHLSPackager()
+
+func NewHLSPackager() *HLSPackager {
+
+	packager := &HLSPackager{}
+
+	packager.jobs		= make(map[string]*hlsJob)
+	packager.semaphore	= NewSemaphore(HLS_MAX_CONCURRENT, 0)
+
+	return packager
+
+}
+
+func hlsDir(key string) string {
+	return filepath.Join(gAppInfo.MetadataDir, HLS_DIR, key)
+}
+
+// hlsComplete checks if the playlist is finished
+func hlsComplete(key string) bool {
+	data, err := ioReadFile(filepath.Join(hlsDir(key), HLS_PLAYLIST))
+	return err == nil && bytes.Contains(data, []byte(HLS_ENDLIST))
+}
+
+// Package returns the job of the file, starting one if there is none
+func (packager *HLSPackager) Package(key, fullpath string, media *MediaInfo) *hlsJob {
+
+	packager.mu.Lock()
+	defer packager.mu.Unlock()
+
+	// Failed ones are not tried on every request but after a while
+	if job, ok := packager.jobs[key]; ok && (job.retry.IsZero() || time.Now().Before(job.retry)) {
+		return job
+	}
+
+	job := &hlsJob{done: make(chan struct{})}
+	packager.jobs[key] = job
+
+	go func() {
+		packager.semaphore.Acquire()
+		err := packager.run(key, fullpath, media)
+		packager.semaphore.Release()
+
+		// Failed ones stay until HLS_RETRY_AFTER
+		packager.mu.Lock()
+		job.err = err
+		if err != nil {
+			logError("Failed to package", fullpath, "err:", err)
+			job.retry = time.Now().Add(HLS_RETRY_AFTER)
+		} else {
+			logInfo("Packaged", fullpath, "for HLS")
+			delete(packager.jobs, key)
+		}
+		packager.mu.Unlock()
+		close(job.done)
+	}()
+
+	return job
+
+}
+
+// hlsCopiesVideo checks if the video stream is copied rather than re-encoded
+func hlsCopiesVideo(media *MediaInfo) bool {
+	return media != nil && (media.VideoCodec == "h264" || media.VideoCodec == "hevc")
+}
+
+func hlsArgs(fullpath, dir string, media *MediaInfo) []string {
+
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "error",
+		"-i", fullpath, "-map", "0:v:0", "-map", "0:a:0?", "-sn",
+	}
+
+	// Video
+	videoCodec := ""
+	if media != nil {
+		videoCodec = media.VideoCodec
+	}
+	switch videoCodec {
+	case "h264":
+		args = append(args, "-c:v", "copy")
+	case "hevc":
+		args = append(args, "-c:v", "copy", "-tag:v", "hvc1")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p")
+	}
+
+	// Audio
+	if media != nil && media.AudioCodec == "aac" {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "192k", "-ac", "2")
+	}
+
+	return append(args,
+		"-f", "hls",
+		"-hls_time", HLS_SEGMENT_SECONDS,
+		"-hls_playlist_type", "event",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", HLS_INIT,
+		"-hls_segment_filename", filepath.Join(dir, "seg_%05d.m4s"),
+		filepath.Join(dir, HLS_PLAYLIST),
+	)
+
+}
+
+func (packager *HLSPackager) run(key, fullpath string, media *MediaInfo) error {
+
+	dir := hlsDir(key)
+
+	// Unfinished ones are done again
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	devNull, err := ioOpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	// Limited by packager.semaphore instead of the slots of bakes which it would hold for long
+	err = runFFmpeg(hlsArgs(fullpath, dir, media), devNull, devNull)
+	if err == nil && !hlsComplete(key) {
+		err = fmt.Errorf("Playlist is not finished")
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+
+}
+
+// parseHLSPath returns the album, base and name of /hls/<album>/<file>/<name>
+func parseHLSPath(urlPath string) (string, string, string, bool) {
+
+	parts := strings.Split(strings.TrimPrefix(urlPath, URL_HLS), "/")
+	if len(parts) < 2 {
+		return "", "", "", false
+	}
+
+	n := len(parts)
+	return strings.Join(parts[:n - 2], "/"), parts[n - 2], parts[n - 1], true
+
+}
+
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+
+	album, base, name, ok := parseHLSPath(r.URL.Path)
+	if !ok || (name != HLS_PLAYLIST && !gHLSSegmentRegex.MatchString(name)) {
+		logHTTPRequest(r, -1, "hls Malformed path")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	dir, err := getAlbumDir(album)
+	if err != nil {
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+	meta, ok := gMetadataManager.GetMetadata(dir, base)
+	if !ok || strings.SplitN(meta.MimeType, "/", 2)[0] != MIME_VIDEO {
+		logHTTPRequest(r, -1, "hls Not Found", dir, base)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if meta.Crc32 == "" {
+		http.Error(w, "File is being indexed", http.StatusServiceUnavailable)
+		return
+	}
+	touchCache(hlsDir(meta.contentKey()))
+
+	if name != HLS_PLAYLIST {
+		serveHLSFile(w, r, filepath.Join(hlsDir(meta.contentKey()), name), "public, max-age=86400")
+		return
+	}
+
+	// Playlist
+	if hlsComplete(meta.contentKey()) {
+		serveHLSFile(w, r, filepath.Join(hlsDir(meta.contentKey()), name), "no-cache")
+		return
+	}
+	if !PERF_HLS_REENCODE && !hlsCopiesVideo(meta.Media) {
+		logHTTPRequest(r, -1, "hls Re-encoding is disabled", dir, base)
+		http.Error(w, "Re-encoding is not supported", http.StatusUnprocessableEntity)
+		return
+	}
+
+	job := gHLSPackager.Package(meta.contentKey(), filepath.Join(dir, base), meta.Media)
+	playlistPath := filepath.Join(hlsDir(meta.contentKey()), HLS_PLAYLIST)
+	timeout := time.After(HLS_WAIT)
+	for {
+		// Playable once a segment is listed
+		data, err := ioReadFile(playlistPath)
+		if err == nil && bytes.Contains(data, []byte("#EXTINF")) {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(data)
+			return
+		}
+		select {
+		case <-job.done:
+			if job.err != nil {
+				logHTTPRequest(r, -1, "hls failed", dir, base)
+				http.Error(w, "Failed to package", http.StatusUnprocessableEntity)
+				return
+			}
+		case <-time.After(HLS_POLL):
+		case <-timeout:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Packaging", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+}
+
+func serveHLSFile(w http.ResponseWriter, r *http.Request, fullpath, cacheControl string) {
+
+	file, err := ioOpen(fullpath)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPRequest(r, -1, "hls ioOpen", fullpath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch filepath.Ext(fullpath) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+	case ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(w, r, filepath.Base(fullpath), info.ModTime(), file)
+
+}
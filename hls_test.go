@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseHLSPath(t *testing.T) {
+
+	tests := []struct {
+		path				string
+		album, base, name	string
+		ok					bool
+	}{
+		{"/hls/a.mp4/index.m3u8", "", "a.mp4", "index.m3u8", true},
+		{"/hls/trip/a.mp4/seg_00001.m4s", "trip", "a.mp4", "seg_00001.m4s", true},
+		{"/hls/trip/2024/봄/a b.mp4/init.mp4", "trip/2024/봄", "a b.mp4", "init.mp4", true},
+		{"/hls/a.mp4/", "", "a.mp4", "", true},
+		{"/hls/index.m3u8", "", "", "", false},
+		{"/hls/", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		album, base, name, ok := parseHLSPath(tt.path)
+		if album != tt.album || base != tt.base || name != tt.name || ok != tt.ok {
+			t.Errorf("parseHLSPath(%q) = %q, %q, %q, %v, want %q, %q, %q, %v",
+				tt.path, album, base, name, ok, tt.album, tt.base, tt.name, tt.ok)
+		}
+	}
+
+}
+
+func TestHLSPackageRetriesFailed(t *testing.T) {
+
+	gAppInfo.MetadataDir = t.TempDir()
+	packager := NewHLSPackager()
+	missing := filepath.Join(t.TempDir(), "missing.mp4")
+
+	job := packager.Package("00000000_1", missing, &MediaInfo{VideoCodec: "h264"})
+	<-job.done
+	if job.err == nil {
+		t.Fatal("want error of a missing file")
+	}
+
+	if again := packager.Package("00000000_1", missing, nil); again != job {
+		t.Error("failed job is tried again before HLS_RETRY_AFTER")
+	}
+
+	packager.mu.Lock()
+	job.retry = time.Now().Add(-time.Second)
+	packager.mu.Unlock()
+	again := packager.Package("00000000_1", missing, nil)
+	if again == job {
+		t.Error("failed job is not tried again after HLS_RETRY_AFTER")
+	}
+	<-again.done
+
+}
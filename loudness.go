@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Loudness analysis by the loudnorm filter of ffmpeg
+//
+// Gains are suggested for the ReplayGain 2.0 reference, album gain is computed from
+// the duration weighted loudness of the audio files in the same dir.
+
+const LOUDNESS_REFERENCE = -18.0 // LUFS
+
+type MetadataLoudness struct {
+	Integrated		float64		`json:"integrated"` // LUFS
+	TruePeak		float64		`json:"truePeak"` // dBTP
+	Range			float64		`json:"range"` // LU
+	TrackGain		float64		`json:"trackGain"` // dB
+	AlbumGain		float64		`json:"albumGain"` // dB
+}
+
+func analyzeLoudness(fullpath string) (*MetadataLoudness, error) {
+
+	suffix, err := generateRandomString(8)
+	if err != nil {
+		return nil, err
+	}
+	logPath := filepath.Join(os.TempDir(), "pocketserver-loudnorm-" + suffix + ".log")
+
+	stderr, err := ioOpenFile(logPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer ioRemove(logPath)
+
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats",
+		"-i", fullpath,
+		"-vn",
+		"-af", "loudnorm=print_format=json",
+		"-f", "null", "-",
+	}
+	// Nothing is written to stdout by the null muxer
+	err = executeFFmpeg(args, stderr, stderr)
+	stderr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ioReadFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLoudnorm(string(out))
+
+}
+
+// parseLoudnorm parses the json printed at the end of the output,
+// returns nil without error when there is no loudness e.g. silence or clips shorter than 3 seconds
+func parseLoudnorm(out string) (*MetadataLoudness, error) {
+
+	start := strings.LastIndex(out, "{")
+	end := strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("No loudnorm output")
+	}
+
+	values := make(map[string]string)
+	err := json.Unmarshal([]byte(out[start:end + 1]), &values)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed loudnorm output: %w", err)
+	}
+
+	// -inf or nan when not measurable
+	measurable := true
+	parse := func(key string) (float64, error) {
+		v, err := strconv.ParseFloat(values[key], 64)
+		if err != nil {
+			return 0, fmt.Errorf("Malformed %s %q", key, values[key])
+		}
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			measurable = false
+		}
+		return v, nil
+	}
+
+	loudness := &MetadataLoudness{}
+	if loudness.Integrated, err = parse("input_i"); err != nil {
+		return nil, err
+	}
+	if loudness.TruePeak, err = parse("input_tp"); err != nil {
+		return nil, err
+	}
+	if loudness.Range, err = parse("input_lra"); err != nil {
+		return nil, err
+	}
+	if !measurable {
+		return nil, nil
+	}
+	loudness.TrackGain = roundGain(LOUDNESS_REFERENCE - loudness.Integrated)
+	loudness.AlbumGain = loudness.TrackGain
+
+	return loudness, nil
+
+}
+
+func roundGain(gain float64) float64 {
+	return math.Round(gain * 100) / 100
+}
+
+// updateAlbumGain must be called while holding cache.bodyMu,
+// returns the bases whose album gain is changed
+func (cache *metadataCache) updateAlbumGain() []string {
+
+	var energy, weights float64
+	for _, meta := range cache.body.MetaMap {
+		if meta.Loudness == nil {
+			continue
+		}
+		weight := 1.0
+		if meta.Media != nil && meta.Media.Duration > 0 {
+			weight = meta.Media.Duration
+		}
+		energy += weight * math.Pow(10, meta.Loudness.Integrated / 10)
+		weights += weight
+	}
+	if weights == 0 {
+		return nil
+	}
+
+	albumGain := roundGain(LOUDNESS_REFERENCE - 10 * math.Log10(energy / weights))
+
+	changed := make([]string, 0)
+	for base, meta := range cache.body.MetaMap {
+		if meta.Loudness != nil && meta.Loudness.AlbumGain != albumGain {
+			meta.Loudness.AlbumGain = albumGain
+			changed = append(changed, base)
+		}
+	}
+
+	return changed
+
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLoudnorm(t *testing.T) {
+
+	output := func(i, tp, lra string) string {
+		return "[Parsed_loudnorm_0 @ 0x1] {ignored}\n{\n" +
+			"\t\"input_i\" : \"" + i + "\",\n" +
+			"\t\"input_tp\" : \"" + tp + "\",\n" +
+			"\t\"input_lra\" : \"" + lra + "\",\n" +
+			"\t\"input_thresh\" : \"-30.00\"\n}\n"
+	}
+
+	tests := []struct {
+		name	string
+		out		string
+		want	*MetadataLoudness
+		err		bool
+	}{
+		{"measured", output("-20.00", "-1.20", "5.00"), &MetadataLoudness{-20, -1.2, 5, 2, 2}, false},
+		{"loud", output("-8.34", "0.50", "3.10"), &MetadataLoudness{-8.34, 0.5, 3.1, -9.66, -9.66}, false},
+		{"silence", output("-inf", "-inf", "0.00"), nil, false},
+		{"too short", output("-70.00", "nan", "0.00"), nil, false},
+		{"no json", "Error opening input file", nil, true},
+		{"malformed json", "{\"input_i\": }", nil, true},
+		{"malformed value", output("loud", "-1.20", "5.00"), nil, true},
+		{"missing value", "{\"input_i\" : \"-20.00\"}", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLoudnorm(tt.out)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("want error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Typed media info parsed from the ffprobe json of META_EXT_TXT
+
+type MediaInfo struct {
+	Duration		float64				`json:"duration,omitempty"` // seconds
+	Bitrate			int64				`json:"bitrate,omitempty"`
+	Tags			map[string]string	`json:"tags,omitempty"` // lowercase keys
+	AudioCodec		string				`json:"audioCodec,omitempty"`
+	SampleRate		int					`json:"sampleRate,omitempty"`
+	Channels		int					`json:"channels,omitempty"`
+	VideoCodec		string				`json:"videoCodec,omitempty"`
+	Width			int					`json:"width,omitempty"`
+	Height			int					`json:"height,omitempty"`
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		Duration	string				`json:"duration"`
+		Bitrate		string				`json:"bit_rate"`
+		Tags		map[string]string	`json:"tags"`
+	}									`json:"format"`
+	Streams []struct {
+		CodecType	string				`json:"codec_type"`
+		CodecName	string				`json:"codec_name"`
+		Bitrate		string				`json:"bit_rate"`
+		SampleRate	string				`json:"sample_rate"`
+		Channels	int					`json:"channels"`
+		Width		int					`json:"width"`
+		Height		int					`json:"height"`
+		Tags		map[string]string	`json:"tags"`
+		Disposition	struct {
+			AttachedPic	int				`json:"attached_pic"`
+		}								`json:"disposition"`
+	}									`json:"streams"`
+}
+
+// lacksStreams tells it is of the old ffprobe json which had only the tags of audio streams
+func (media *MediaInfo) lacksStreams() bool {
+	return media.AudioCodec == "" && media.VideoCodec == ""
+}
+
+// mediaInfoOutdated tells the ffprobe json at path is to be made again
+func mediaInfoOutdated(path string) bool {
+
+	data, err := ioReadFile(path)
+	if err != nil {
+		return true
+	}
+	media, err := parseMediaInfo(data)
+
+	return err != nil || media.lacksStreams()
+
+}
+
+func parseMediaInfo(data []byte) (*MediaInfo, error) {
+
+	var out ffprobeOutput
+	err := json.Unmarshal(data, &out)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed ffprobe output: %w", err)
+	}
+
+	media := &MediaInfo{}
+
+	// N/A for images
+	media.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	media.Bitrate, _ = strconv.ParseInt(out.Format.Bitrate, 10, 64)
+
+	addTags := func(tags map[string]string) {
+		for k, v := range tags {
+			k = strings.ToLower(k)
+			if _, ok := media.Tags[k]; !ok && v != "" {
+				if media.Tags == nil {
+					media.Tags = make(map[string]string)
+				}
+				media.Tags[k] = v
+			}
+		}
+	}
+
+	// Format tags take priority over stream tags like the client
+	addTags(out.Format.Tags)
+
+	for _, stream := range out.Streams {
+		switch stream.CodecType {
+		case MIME_AUDIO:
+			if media.AudioCodec != "" {
+				continue
+			}
+			media.AudioCodec = stream.CodecName
+			media.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+			media.Channels = stream.Channels
+			if media.Bitrate == 0 {
+				media.Bitrate, _ = strconv.ParseInt(stream.Bitrate, 10, 64)
+			}
+			addTags(stream.Tags)
+		case MIME_VIDEO:
+			// Artwork of audio
+			if media.VideoCodec != "" || stream.Disposition.AttachedPic != 0 {
+				continue
+			}
+			media.VideoCodec = stream.CodecName
+			media.Width = stream.Width
+			media.Height = stream.Height
+		}
+	}
+
+	return media, nil
+
+}
@@ -8,6 +8,9 @@ import (
 	"sync/atomic"
 	"path/filepath"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"encoding/json"
 )
@@ -18,11 +21,85 @@ type Metadata struct {
 	IsDir			bool		`json:"isDir"`
 	MimeType		string		`json:"mimeType"`
 	Crc32			string		`json:"crc32"`
+	Bake			*MetadataBake	`json:"bake,omitempty"`
+	Media			*MediaInfo		`json:"media,omitempty"`
+	Loudness		*MetadataLoudness	`json:"loudness,omitempty"`
+	Sprite			*MetadataSprite	`json:"sprite,omitempty"`
+	Display			*MetadataDisplay	`json:"display,omitempty"`
+	Exif			*MetadataExif	`json:"exif,omitempty"`
+	Waveform		*MetadataWaveform	`json:"waveform,omitempty"`
 }
 type MetadataMap map[string] *Metadata
+
+// fill sets the fields read from the file system, returns whether they are changed
+func (meta *Metadata) fill(fullpath string, info fs.FileInfo) bool {
+
+	prev := *meta
+
+	meta.ModTime	= info.ModTime()
+	meta.Size		= info.Size()
+	meta.IsDir		= info.IsDir()
+	meta.MimeType	= mimeTypeByName(fullpath)
+
+	// For files
+	if false == info.IsDir() {
+
+		// Sniffed only when the file is new or changed
+		if meta.MimeType == "" {
+			if prev.ModTime.Equal(meta.ModTime) && prev.Size == meta.Size {
+				meta.MimeType = prev.MimeType
+			} else {
+				meta.MimeType = sniffHEIF(fullpath)
+			}
+		}
+
+		// Check crc, again when the file is changed in place
+		if !prev.ModTime.Equal(meta.ModTime) || prev.Size != meta.Size {
+			meta.Crc32 = ""
+		}
+		if meta.Crc32 == "" || meta.Crc32 == "0" {
+			var err error
+			meta.Crc32, err = getCRC32OfFile(fullpath)
+			if err != nil {
+				logWarn("Failed to get CRC of file:", fullpath)
+			}
+		}
+
+		// Read once per change
+		if !hasExif(meta.MimeType) {
+			meta.Exif = nil
+		} else if meta.Exif == nil || !prev.ModTime.Equal(meta.ModTime) || prev.Size != meta.Size {
+			exif, err := readExif(fullpath, meta.MimeType)
+			if err != nil {
+				logDebug("Failed to read EXIF of", fullpath, err)
+				exif = &MetadataExif{}
+			}
+			meta.Exif = exif
+		}
+
+	}
+
+	return !prev.fieldsEqual(meta) || prev.Exif != meta.Exif
+
+}
+
+// contentKey names the outputs made from the content, the size lessens collisions of crc
+func (meta *Metadata) contentKey() string {
+	return meta.Crc32 + "_" + strconv.FormatInt(meta.Size, 10)
+}
+
+// fieldsEqual compares the fields read from the file system
+func (meta *Metadata) fieldsEqual(meta1 *Metadata) bool {
+	return meta.ModTime.Equal(meta1.ModTime) &&
+		meta.Size == meta1.Size &&
+		meta.IsDir == meta1.IsDir &&
+		meta.MimeType == meta1.MimeType &&
+		meta.Crc32 == meta1.Crc32
+}
 type MetadataBody struct {
 	MetaMap		MetadataMap	`json:"metaMap"`
 	Playlist	[]string	`json:"playlist"`
+	Playlists	[]*Playlist	`json:"playlists"`
 }
 
 type metadataCache struct {
@@ -30,23 +107,49 @@ type metadataCache struct {
 
 	body			MetadataBody
 	bodyMu			sync.Mutex
-	json			atomic.Pointer[[]byte]
+	json			atomic.Pointer[metadataSnapshot]
 	dir				string
 
+	// Versions for delta, guarded by bodyMu
+	version			uint64
+	minVersion		uint64 // deltas since older ones are not known
+	versions		map[string]uint64 // by base
+	removed			map[string]uint64 // by base
+	playlistVersion	uint64
+
 	update			func()
+
+	// Watching
+	wd				int
+	watched			atomic.Bool
+	pending			map[string]struct{}
+	pendingMu		sync.Mutex
+	refreshLater	func()
+}
+
+type metadataSnapshot struct {
+	data			[]byte
+	version			uint64
 }
 
 type MetadataManager struct {
+	store		MetadataStore
+	baker		*MetadataBaker
+	watcher		metadataWatcher // nil when not supported
+	version		atomic.Uint64 // shared by caches so that versions grow across restarts
 	cacheMap	map[string] *metadataCache
 	cacheMapMu	sync.RWMutex // cache registration
 	updateMu	sync.Mutex // only one update at a time
 }
 
 
-func NewMetadataManager() *MetadataManager {
+func NewMetadataManager(store MetadataStore) *MetadataManager {
 
 	mgr := &MetadataManager{}
 
+	mgr.store		= store
+	mgr.version.Store(uint64(time.Now().UnixMicro()))
+	mgr.baker		= NewMetadataBaker(mgr, PERF_FFMPEG_MAX_CONCURRENT)
 	mgr.cacheMap	= make(map[string]*metadataCache)
 
 	return mgr
@@ -63,28 +166,49 @@ func (mgr *MetadataManager) getCache(dir string) (*metadataCache, bool) {
 
 }
 
-func (mgr *MetadataManager) Get(dir string) ([]byte, bool) {
+func (mgr *MetadataManager) Get(dir string) ([]byte, uint64, bool) {
 
 	cache, ok := mgr.getCache(dir)
 	if !ok {
-		return nil, false
+		return nil, 0, false
 	}
 
-	return *cache.json.Load(), true
+	snapshot := cache.json.Load()
+	return snapshot.data, snapshot.version, true
 
 }
 
-func (cache *metadataCache) updateJson() {
+// updateJson returns the json of the body it stores as the snapshot
+func (cache *metadataCache) updateJson() []byte {
 
 	data, err := json.Marshal(cache.body)
 	if err != nil {
 		panic(err)
 	}
-	cache.json.Store(&data)
+	cache.json.Store(&metadataSnapshot{data, cache.version})
+
+	return data
+
+}
+
+// save must be called while holding cache.bodyMu, it stores the entries of bases
+// and the playlist when playlist is true
+func (cache *metadataCache) save(playlist bool, bases ...string) {
+
+	cache.bumpVersion(playlist, bases)
+	data := cache.updateJson()
 
-	err = ioWriteFile(cache.mgr.formatDirCacheName(cache.dir), data, 0644)
+	gEventHub.Publish(Event{
+		Type:		EVENT_METADATA,
+		Album:		getAlbumOfDir(cache.dir),
+		Version:	cache.version,
+		Bases:		bases,
+		Playlist:	playlist,
+	})
+
+	err := cache.mgr.store.Save(cache.dir, &cache.body, data, playlist, bases)
 	if err != nil {
-		logError("Failed to write cache file", cache.dir, "err:", err)
+		logError("Failed to save cache", cache.dir, "err:", err)
 	}
 
 }
@@ -101,16 +225,16 @@ func (mgr *MetadataManager) EditPlaylist(dir string, pl1 []string) error {
 
 	for _, base := range pl1 {
 		if meta, ok := cache.body.MetaMap[base]; !ok {
-			return fmt.Errorf("File doesn't exist", base)
+			return fmt.Errorf("File doesn't exist %s", base)
 		} else {
 			if strings.SplitN(meta.MimeType, "/", 2)[0] != MIME_AUDIO {
-				return fmt.Errorf("Not an audio file", base)
+				return fmt.Errorf("Not an audio file %s", base)
 			}
 		}
 	}
 
 	cache.body.Playlist = pl1
-	cache.updateJson()
+	cache.save(true)
 
 	return nil
 
@@ -127,7 +251,10 @@ func (mgr *MetadataManager) GetMetadata(dir, base string) (Metadata, bool) {
 	defer cache.bodyMu.Unlock()
 
 	meta, ok := cache.body.MetaMap[base]
-	return *meta, ok
+	if !ok {
+		return Metadata{}, false
+	}
+	return *meta, true
 
 }
 
@@ -148,66 +275,324 @@ func (mgr *MetadataManager) SetMetadata(dir, base string, info fs.FileInfo, crc
 		MimeType:	mimeTypeByName(base),
 		Crc32:		crc,
 	}
-	cache.updateJson()
+	cache.save(false, base)
+	cache.scheduleBake(base, cache.body.MetaMap[base])
 
 	return nil
 
 }
 
-func (mgr *MetadataManager) parseDirCacheName(jsonBase string) string {
-	jsonBase = strings.TrimSuffix(jsonBase, ".json")
-	return filepath.Join(strings.Split(jsonBase, META_SLASH_IN_FILENAME)...)
+type MetadataLocation struct {
+	Dir			string		`json:"-"`
+	Album		string		`json:"album"`
+	Base		string		`json:"base"`
+	Size		int64		`json:"size"`
+	Crc32		string		`json:"crc32"`
 }
 
-func (mgr *MetadataManager) formatDirCacheName(dir string) string {
-	dir = strings.ReplaceAll(dir, "/", META_SLASH_IN_FILENAME)
-	dir = strings.ReplaceAll(dir, "\\", META_SLASH_IN_FILENAME)
-	return filepath.Join(gAppInfo.MetadataDir, dir) + ".json"
+// FindByCrc looks up files of the given crc and size across all dirs
+func (mgr *MetadataManager) FindByCrc(crc string, size int64) []MetadataLocation {
+
+	mgr.cacheMapMu.RLock()
+	defer mgr.cacheMapMu.RUnlock()
+
+	locs := make([]MetadataLocation, 0)
+	for dir, cache := range mgr.cacheMap {
+
+		cache.bodyMu.Lock()
+		for base, meta := range cache.body.MetaMap {
+			if meta.IsDir || meta.Crc32 != crc || meta.Size != size {
+				continue
+			}
+			locs = append(locs, MetadataLocation{
+				Dir:	dir,
+				Album:	getAlbumOfDir(dir),
+				Base:	base,
+				Size:	meta.Size,
+				Crc32:	meta.Crc32,
+			})
+		}
+		cache.bodyMu.Unlock()
+
+	}
+
+	return locs
+
 }
 
-func (mgr *MetadataManager) LoadDirCaches() error {
+// getMetadataSidecars returns the extensions of metadata files made for the file
+func getMetadataSidecars(dir, base string) ([]string, error) {
 
-	jsonPaths, err := filepath.Glob(filepath.Join(gAppInfo.MetadataDir, "*.json"))
+	exts := make([]string, 0)
+	for _, ext := range gMetaExts {
+		info, err := ioStat(filepath.Join(gAppInfo.MetadataDir, dir, base) + ext)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			exts = append(exts, ext)
+		}
+	}
+
+	return exts, nil
+
+}
+
+// removeMetadataSidecars removes the metadata files made for the file
+func removeMetadataSidecars(dir, base string) {
+
+	exts, err := getMetadataSidecars(dir, base)
+	if err != nil {
+		logWarn("Failed to read metadata of", base, err)
+		return
+	}
+
+	for _, ext := range exts {
+		err = ioRemove(filepath.Join(gAppInfo.MetadataDir, dir, base) + ext)
+		if err != nil {
+			logWarn("Failed to remove metadata of", base, ext, err)
+		}
+	}
+
+}
+
+// moveMetadataSidecars moves or copies the metadata files made for the file
+func moveMetadataSidecars(dir, base, newDir, newBase string, copy bool) {
+
+	exts, err := getMetadataSidecars(dir, base)
 	if err != nil {
+		logWarn("Failed to read metadata of", base, err)
+		return
+	}
+
+	for _, ext := range exts {
+		src := filepath.Join(gAppInfo.MetadataDir, dir, base) + ext
+		dst := filepath.Join(gAppInfo.MetadataDir, newDir, newBase) + ext
+		if copy {
+			err = copyFile(src, dst)
+		} else {
+			err = os.Rename(src, dst)
+		}
+		if err != nil {
+			logWarn("Failed to move metadata of", base, ext, err)
+		}
+	}
+
+}
+
+// RemoveFile removes the file, its metadata files and its entries
+func (mgr *MetadataManager) RemoveFile(dir, base string) error {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return fmt.Errorf("Dir not found")
+	}
+
+	mgr.updateMu.Lock()
+	defer mgr.updateMu.Unlock()
+
+	cache.bodyMu.Lock()
+
+	meta, ok := cache.body.MetaMap[base]
+	if !ok {
+		cache.bodyMu.Unlock()
+		return fmt.Errorf("File not found %s", base)
+	}
+	if meta.IsDir {
+		cache.bodyMu.Unlock()
+		return fmt.Errorf("Cannot remove a dir %s", base)
+	}
+
+	err := ioRemove(filepath.Join(dir, base))
+	if err != nil && !os.IsNotExist(err) {
+		cache.bodyMu.Unlock()
 		return err
 	}
+	removeMetadataSidecars(dir, base)
 
-	for _, jsonPath := range jsonPaths {
+	album := getAlbumOfDir(dir)
+	delete(cache.body.MetaMap, base)
+	cache.body.Playlist = removeFromPlaylist(cache.body.Playlist, base)
+	cache.removeFromPlaylists(album, base)
+	cache.save(true, append(cache.updateAlbumGain(), base)...)
+	cache.bodyMu.Unlock()
 
-		dir := mgr.parseDirCacheName(filepath.Base(jsonPath))
+	// Named playlists of other albums can reference it
+	mgr.editOtherPlaylists(cache, func(cache1 *metadataCache) bool {
+		return cache1.removeFromPlaylists(album, base)
+	})
 
-		mgr.AddDir(dir)
-		
-		err = func() error {
-
-			mgr.cacheMapMu.RLock()
-			defer mgr.cacheMapMu.RUnlock()
-		
-			cache, ok := mgr.cacheMap[dir]
-			if !ok {
-				panic("Cannot find cache for " + dir)
-			}
+	return nil
 
-			data, err := ioReadFile(jsonPath)
-			if err != nil {
-				return err
+}
+
+// MoveFile moves or copies the file along with its metadata files and entries,
+// returns the base name in newDir which differs from newBase if it is taken
+func (mgr *MetadataManager) MoveFile(dir, base, newDir, newBase string, copy bool) (string, error) {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return "", fmt.Errorf("Dir not found")
+	}
+	newCache, ok := mgr.getCache(newDir)
+	if !ok {
+		return "", fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	meta0, ok := cache.body.MetaMap[base]
+	if !ok || meta0.IsDir {
+		cache.bodyMu.Unlock()
+		return "", fmt.Errorf("File not found %s", base)
+	}
+	meta := *meta0
+	if meta.Loudness != nil {
+		// Album gain differs by album
+		loudness := *meta.Loudness
+		meta.Loudness = &loudness
+	}
+	cache.bodyMu.Unlock()
+
+	// Same name is kept for moving in place
+	if dir != newDir || base != newBase {
+		newBase = recursiveNewName(newDir, newBase)
+	}
+
+	src := filepath.Join(dir, base)
+	dst := filepath.Join(newDir, newBase)
+	var err error
+	if copy {
+		err = copyFile(src, dst)
+	} else {
+		err = os.Rename(src, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	moveMetadataSidecars(dir, base, newDir, newBase, copy)
+
+	info, err := ioStat(dst)
+	if err != nil {
+		return "", err
+	}
+	meta.ModTime = info.ModTime()
+	meta.MimeType = mimeTypeByName(newBase)
+
+	// Both albums are edited at once, the destination is saved first
+	// so that readers see the file in either album while moving
+	album, newAlbum := getAlbumOfDir(dir), getAlbumOfDir(newDir)
+	mgr.updateMu.Lock()
+	defer mgr.updateMu.Unlock()
+	cache.bodyMu.Lock()
+	if newCache != cache {
+		newCache.bodyMu.Lock()
+	}
+
+	// Source
+	inPlace := -1
+	if !copy {
+		if dir == newDir {
+			for i, v := range cache.body.Playlist {
+				if v == base {
+					inPlace = i
+				}
 			}
-		
-			cache.bodyMu.Lock()
-			defer cache.bodyMu.Unlock()
-	
-			cache.json.Store(&data)
-			err = json.Unmarshal(data, &cache.body)
-			if err != nil {
-				return err
+		}
+		delete(cache.body.MetaMap, base)
+		cache.body.Playlist = removeFromPlaylist(cache.body.Playlist, base)
+		cache.moveInPlaylists(album, base, newAlbum, newBase)
+	}
+
+	// Destination
+	newCache.body.MetaMap[newBase] = &meta
+	if strings.SplitN(meta.MimeType, "/", 2)[0] == MIME_AUDIO {
+		pl := newCache.body.Playlist
+		if inPlace >= 0 && inPlace <= len(pl) {
+			// Renamed in the same dir keeps its position
+			pl = append(pl[:inPlace], append([]string{newBase}, pl[inPlace:]...)...)
+		} else {
+			pl = append(pl, newBase)
+		}
+		newCache.body.Playlist = pl
+	}
+	if newCache != cache && !copy {
+		newCache.moveInPlaylists(album, base, newAlbum, newBase)
+	}
+
+	if newCache == cache {
+		bases := []string{newBase}
+		if !copy && base != newBase {
+			bases = append(bases, base)
+		}
+		cache.save(true, append(cache.updateAlbumGain(), bases...)...)
+	} else {
+		newCache.save(true, append(newCache.updateAlbumGain(), newBase)...)
+		if !copy {
+			cache.save(true, append(cache.updateAlbumGain(), base)...)
+		}
+	}
+	newCache.scheduleBake(newBase, &meta)
+
+	if newCache != cache {
+		newCache.bodyMu.Unlock()
+	}
+	cache.bodyMu.Unlock()
+
+	// Named playlists of other albums can reference it
+	if !copy {
+		mgr.editOtherPlaylists(nil, func(cache1 *metadataCache) bool {
+			if cache1 == cache || cache1 == newCache {
+				return false
 			}
+			return cache1.moveInPlaylists(album, base, newAlbum, newBase)
+		})
+		gPlayHistory.Move(album, base, newAlbum, newBase)
+	}
 
-			return nil
+	return newBase, nil
 
-		}()
-		if err != nil {
-			return err
+}
+
+func removeFromPlaylist(pl []string, base string) []string {
+	pl1 := make([]string, 0, len(pl))
+	for _, v := range pl {
+		if v != base {
+			pl1 = append(pl1, v)
+		}
+	}
+	return pl1
+}
+
+func (mgr *MetadataManager) LoadDirCaches() error {
+
+	bodies, err := mgr.store.Load()
+	if err != nil {
+		return err
+	}
+
+	for dir, body := range bodies {
+
+		mgr.AddDir(dir)
+
+		cache, ok := mgr.getCache(dir)
+		if !ok {
+			panic("Cannot find cache for " + dir)
+		}
+
+		cache.bodyMu.Lock()
+		if body.MetaMap != nil {
+			cache.body.MetaMap = body.MetaMap
 		}
+		if body.Playlist != nil {
+			cache.body.Playlist = body.Playlist
+		}
+		if body.Playlists != nil {
+			cache.body.Playlists = body.Playlists
+		}
+		cache.updateJson()
+		cache.bodyMu.Unlock()
 
 	}
 
@@ -229,6 +614,7 @@ func (mgr *MetadataManager) AddDir(dir string) {
 	body := MetadataBody{}
 	body.MetaMap = make(MetadataMap)
 	body.Playlist = make([]string, 0)
+	body.Playlists = make([]*Playlist, 0)
 	cache := &metadataCache{
 		mgr:	mgr,
 		dir:	dir,
@@ -236,11 +622,246 @@ func (mgr *MetadataManager) AddDir(dir string) {
 	}
 
 	cache.update = throttle(cache._update, IO_EACH_CACHE_COOLDOWN)
+	cache.pending = make(map[string]struct{})
+	cache.refreshLater = debounce(cache.refresh, WATCH_REFRESH_DELAY)
+	cache.version = mgr.version.Add(1)
+	cache.minVersion = cache.version
+	cache.versions = make(map[string]uint64)
+	cache.removed = make(map[string]uint64)
 	mgr.cacheMap[dir] = cache
 
+	// Servable before its first update
+	cache.updateJson()
+
 	// ---
 	must(os.MkdirAll(filepath.Join(gAppInfo.MetadataDir, dir), 0755))
 
+	// Rescanned when not watched
+	if mgr.watcher != nil {
+		if err := mgr.watcher.Add(cache); err != nil {
+			logWarn(err)
+		}
+	}
+
+}
+
+// Dirs returns the registered dirs in order
+func (mgr *MetadataManager) Dirs() []string {
+
+	mgr.cacheMapMu.RLock()
+	defer mgr.cacheMapMu.RUnlock()
+
+	dirs := make([]string, 0, len(mgr.cacheMap))
+	for dir := range mgr.cacheMap {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs
+
+}
+
+// Children returns the sub dirs of the dir
+func (mgr *MetadataManager) Children(dir string) []string {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return nil
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	children := make([]string, 0)
+	for base, meta := range cache.body.MetaMap {
+		if meta.IsDir {
+			children = append(children, filepath.Join(dir, base))
+		}
+	}
+	sort.Strings(children)
+
+	return children
+
+}
+
+// descendants must be called while holding mgr.cacheMapMu
+func (mgr *MetadataManager) descendants(dir string) []string {
+
+	prefix := dir + string(filepath.Separator)
+	dirs := make([]string, 0)
+	for dir1 := range mgr.cacheMap {
+		if strings.HasPrefix(dir1, prefix) {
+			dirs = append(dirs, dir1)
+		}
+	}
+
+	return dirs
+
+}
+
+// RenameDir moves the dir along with its metadata dir and cache file
+func (mgr *MetadataManager) RenameDir(dir, newDir string) error {
+
+	mgr.updateMu.Lock()
+	defer mgr.updateMu.Unlock()
+
+	mgr.cacheMapMu.Lock()
+	defer mgr.cacheMapMu.Unlock()
+
+	cache, ok := mgr.cacheMap[dir]
+	if !ok {
+		return fmt.Errorf("Dir not found %s", dir)
+	}
+	if _, ok := mgr.cacheMap[newDir]; ok {
+		return fmt.Errorf("Dir already exists %s", newDir)
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	err := os.Rename(dir, newDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(filepath.Join(gAppInfo.MetadataDir, dir), filepath.Join(gAppInfo.MetadataDir, newDir))
+	if err != nil && !os.IsNotExist(err) {
+		logWarn("Failed to move metadata dir of", dir, err)
+	}
+
+	// Including sub dirs
+	err = mgr.store.RenameDir(dir, newDir)
+	if err != nil {
+		logWarn("Failed to move cache of", dir, err)
+	}
+
+	delete(mgr.cacheMap, dir)
+	cache.dir = newDir
+	mgr.cacheMap[newDir] = cache
+
+	// Sub dirs are moved along with the dir
+	for _, dir1 := range mgr.descendants(dir) {
+		newDir1 := newDir + dir1[len(dir):]
+		cache1 := mgr.cacheMap[dir1]
+		cache1.bodyMu.Lock()
+		cache1.dir = newDir1
+		cache1.bodyMu.Unlock()
+		delete(mgr.cacheMap, dir1)
+		mgr.cacheMap[newDir1] = cache1
+	}
+
+	// Named playlists of every album referencing the moved ones
+	album, newAlbum := getAlbumOfDir(dir), getAlbumOfDir(newDir)
+	for _, cache1 := range mgr.cacheMap {
+		if cache1 != cache {
+			cache1.bodyMu.Lock()
+		}
+		if cache1.renameAlbumInPlaylists(album, newAlbum) {
+			cache1.save(true)
+		}
+		if cache1 != cache {
+			cache1.bodyMu.Unlock()
+		}
+	}
+	gPlayHistory.MoveAlbum(album, newAlbum)
+
+	logInfo("Renamed", dir, "to", newDir)
+
+	return nil
+
+}
+
+// RemoveDir removes the dir and unregisters its cache
+func (mgr *MetadataManager) RemoveDir(dir string) error {
+
+	mgr.updateMu.Lock()
+	defer mgr.updateMu.Unlock()
+
+	mgr.cacheMapMu.Lock()
+	defer mgr.cacheMapMu.Unlock()
+
+	if _, ok := mgr.cacheMap[dir]; !ok {
+		return fmt.Errorf("Dir not found %s", dir)
+	}
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(filepath.Join(gAppInfo.MetadataDir, dir))
+	if err != nil {
+		logWarn("Failed to remove metadata dir of", dir, err)
+	}
+
+	for _, dir1 := range append(mgr.descendants(dir), dir) {
+		mgr.unregisterDir(dir1)
+	}
+
+	logInfo("Removed", dir)
+
+	return nil
+
+}
+
+// unregisterDir must be called while holding mgr.cacheMapMu
+func (mgr *MetadataManager) unregisterDir(dir string) {
+
+	err := mgr.store.RemoveDir(dir)
+	if err != nil {
+		logWarn("Failed to remove cache of", dir, err)
+	}
+
+	if cache, ok := mgr.cacheMap[dir]; ok && mgr.watcher != nil {
+		mgr.watcher.Remove(cache)
+	}
+
+	delete(mgr.cacheMap, dir)
+
+}
+
+// syncChildren registers new sub dirs and unregisters removed ones
+func (mgr *MetadataManager) syncChildren(added, removed []string) {
+
+	for _, dir := range added {
+		mgr.AddDir(dir)
+	}
+
+	if len(removed) == 0 {
+		return
+	}
+
+	mgr.cacheMapMu.Lock()
+	defer mgr.cacheMapMu.Unlock()
+
+	for _, dir := range removed {
+		for _, dir1 := range append(mgr.descendants(dir), dir) {
+			err := os.RemoveAll(filepath.Join(gAppInfo.MetadataDir, dir1))
+			if err != nil {
+				logWarn("Failed to remove metadata dir of", dir1, err)
+			}
+			mgr.unregisterDir(dir1)
+		}
+	}
+
+}
+
+// RemoveMetadata removes the entry of base from the cache of dir
+func (mgr *MetadataManager) RemoveMetadata(dir, base string) error {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	delete(cache.body.MetaMap, base)
+	cache.save(false, base)
+
+	return nil
+
 }
 
 func (cache *metadataCache) _update() {
@@ -263,6 +884,7 @@ func (cache *metadataCache) _update() {
 	// Create a copy of the current map
 	mm0 := cache.body.MetaMap
 	mm1 := make(MetadataMap, len(mm0))
+	changed := make([]string, 0)
 
 	// Detect additions and build the new map
 	for _, dentry := range dentries {
@@ -289,31 +911,35 @@ func (cache *metadataCache) _update() {
 
 		}
 
-		mm1[base].ModTime		= info.ModTime()
-		mm1[base].Size			= info.Size()
-		mm1[base].IsDir			= info.IsDir()
-		mm1[base].MimeType		= mimeTypeByName(fullpath)
-
-		// For files
-		if false == info.IsDir() {
-			
-			// Check crc
-			if mm1[base].Crc32 == "" || mm1[base].Crc32 == "0" {
-				mm1[base].Crc32, err = getCRC32OfFile(fullpath)
-				if err != nil {
-					logWarn("Failed to get CRC of file:", fullpath)
-				}
-			}
-
+		if mm1[base].fill(fullpath, info) {
+			changed = append(changed, base)
 		}
+		cache.scheduleBake(base, mm1[base])
 
 	}
 
 	// Detect removals
+	removedDirs := make([]string, 0)
+	playlistChanged := false
 	for base := range mm0 {
 		if _, ok := mm1[base]; !ok {
 			removed++
-			// TODO: Handle removed file (e.g., clean up metadata)
+			if cache.removeFromPlaylists(getAlbumOfDir(dir), base) {
+				playlistChanged = true
+			}
+			changed = append(changed, base)
+			removeMetadataSidecars(dir, base)
+			if mm0[base].IsDir {
+				removedDirs = append(removedDirs, filepath.Join(dir, base))
+			}
+		}
+	}
+
+	// Sub dirs
+	childDirs := make([]string, 0)
+	for base := range mm1 {
+		if mm1[base].IsDir {
+			childDirs = append(childDirs, filepath.Join(dir, base))
 		}
 	}
 
@@ -323,9 +949,9 @@ func (cache *metadataCache) _update() {
 	var pl1keys = make(map[string]struct{})
 
 	// PLAYLSIT Handle removed
-	for i, base := range cache.body.Playlist {
+	for _, base := range cache.body.Playlist {
 		if _, ok := mm1[base]; ok {
-			pl1[i] = base
+			pl1[count] = base
 			pl1keys[base] = struct{}{}
 			count++
 		} else {
@@ -344,15 +970,22 @@ func (cache *metadataCache) _update() {
 	}
 
 	// 
+	playlistChanged = playlistChanged || !slices.Equal(cache.body.Playlist, pl1)
 	cache.body.MetaMap = mm1
 	cache.body.Playlist = pl1
+	changed = append(changed, cache.updateAlbumGain()...)
 
 	logInfo("Updated cache of", dir, "-", added, "added,", modified, "modified,", removed, "removed")
 
-	cache.updateJson()
+	if len(changed) > 0 || playlistChanged {
+		cache.save(playlistChanged, changed...)
+	}
 
 	cache.bodyMu.Unlock()
 
+	// After unlock as registration locks the cache map
+	cache.mgr.syncChildren(childDirs, removedDirs)
+
 }
 
 func (mgr *MetadataManager) UpdateDir(dir string) error {
@@ -373,218 +1006,3 @@ func (mgr *MetadataManager) UpdateDir(dir string) error {
 	 return nil
 
 }
-/*
-func (cache *metadataCache) ensureMetadataDetails(fullpath string, meta *Metadata) {
-
-	cache.detailsWg.Add(1)
-
-	if cache.checkMetadataDetails(fullpath, meta) == false {
-		cache.scheduleMetadataDetails(fullpath, meta)
-		return
-	}
-
-	cache.detailsWg.Done()
-
-}
-
-func (cache *metadataCache) checkMetadataDetails(fullpath string, meta *Metadata) bool {
-
-	metapath  := filepath.Join(gAppInfo.MetadataDir, fullpath)
-	txtpath   := metapath + META_EXT_TXT
-	thumbpath := metapath + META_EXT_THUMB
-	smallpath := metapath + META_EXT_THUMB_SMALL
-
-	if d, ok := meta.Details["duration"]; !ok || d == "" {
-		return false
-	}
-
-	txt, err := os.ReadFile(txtpath)
-	if err != nil {
-		return false
-	}
-
-	err = json.Unmarshal(txt, &meta.Details)
-	if err != nil {
-		return false
-	}
-
-	// If malformed metadata
-	if meta.Details["duration"] == "" {
-		return false
-	}
-
-	// Thumbnail
-	_, err = os.Stat(thumbpath)
-	if err != nil {
-		return false
-	}
-
-	// Thumbnail for audio
-	if meta.MimeCategory == "audio" {
-		_, err = os.Stat(smallpath)
-		if err != nil {
-			return false
-		}
-	}
-
-	return true
-
-}
-
-func (cache *metadataCache) scheduleMetadataDetails(fullpath string, meta *Metadata) {
-
-	go func() {
-
-		defer cache.detailsWg.Done()
-
-		cache.mgr.bakeSem.Acquire()
-		defer cache.mgr.bakeSem.Release()
-
-		err := cache.mgr.bakeMetadataDetails(fullpath, meta)
-		if err != nil {
-			logWarn("Failed to bake metadata details", fullpath, err)
-		}
-
-	}()
-
-}
-*/
-
-/*
-func (mgr *MetadataManager) bakeMetadataDetails(fullpath string, meta *Metadata) (err error) {
-
-	cat		  := meta.MimeCategory
-	metapath  := filepath.Join(gAppInfo.MetadataDir, fullpath)
-	smallpath := metapath + META_EXT_THUMB_SMALL
-	thumbpath := metapath + META_EXT_THUMB
-	txtpath	  := metapath + META_EXT_TXT
-
-	// Make directory
-	err = os.MkdirAll(filepath.Dir(metapath), 0755)
-	if err != nil {
-		return fmt.Errorf("failed to make directory %s: %w", fullpath, err)
-	}
-
-	parseMetadataLine := func(line string, key string, endAt string) (bool, string) {
-
-		if strings.Contains(line, key) == false {
-			return false, ""
-		}
-
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			return false, ""
-		}
-
-		if key != strings.TrimSpace(parts[0]) {
-			return false, ""
-		}
-
-		val := strings.TrimSpace(parts[1])
-		
-		if endAt != "" {
-			val = strings.SplitN(val, endAt, 2)[0]
-		}
-
-		return true, val
-
-	}
-
-	// Artwork
-	cmd := FFMPEG_CMD_BASE
-	if cat == "audio" {
-		cmd = fmt.Sprintf(cmd+FFMPEG_CMD_AUDIO_THUMB, fullpath, thumbpath)
-	} else {
-		cmd = fmt.Sprintf(cmd+FFMPEG_CMD_VIDEO_THUMB, fullpath, thumbpath)
-	}
-
-	logDebug(cmd)
-	out, err := executeFFmpeg(cmd)
-	if err != nil {
-		return fmt.Errorf("Failed to execute ffmpeg %s: %w", fullpath, err)
-	}
-
-	// Parse metadata lines
-	meta.Details = make(map[string]string)
-	for _, line := range strings.Split(out, "\n") {
-
-		if cat == "audio" {
-			ok, title := parseMetadataLine(line, "title", "")
-			if ok {
-				meta.Details["title"] = title
-			}
-			ok, artist := parseMetadataLine(line, "artist", "")
-			if ok {
-				meta.Details["artist"] = artist
-			}
-			ok, album := parseMetadataLine(line, "album", "")
-			if ok {
-				meta.Details["album"] = album
-			}
-		}
-
-		ok, duration := parseMetadataLine(line, "Duration", ",")
-		if ok {
-			meta.Details["duration"] = duration
-		}
-
-	}
-
-	// Write json
-	txt, err := json.MarshalIndent(meta.Details, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON %s: %w", fullpath, err)
-	}
-	err = os.WriteFile(txtpath, txt, 0644)
-	if err != nil {
-		return fmt.Errorf("Failed to write thumbnail %s: %w", fullpath, err)
-	}
-
-	// Check if malformed media
-	if _, ok := meta.Details["duration"]; !ok {
-		return fmt.Errorf("Malformed media file", fullpath)
-	}
-
-	// Check for image/webp
-	if meta.Details["duration"] == "N/A" ||
-		meta.Details["duration"][:8] == "00:00:00" {
-		err = os.WriteFile(thumbpath, []byte{}, 0644)
-		if err != nil {
-			return fmt.Errorf("Failed to write thumbnail %s: %w", fullpath, err)
-		}
-	}
-
-	// Thumbnail not created
-	_, err = os.Stat(thumbpath)
-	if err != nil {
-		err = os.WriteFile(thumbpath, []byte{}, 0644)
-		if err != nil {
-			return fmt.Errorf("Failed to write thumbnail %s: %w", fullpath, err)
-		}
-	}
-
-	// Small thumbnail for audio
-	if cat == "audio" {
-
-		smallcmd := fmt.Sprintf(
-			FFMPEG_CMD_BASE+FFMPEG_CMD_AUDIO_THUMB_SMALL, 
-			fullpath, smallpath)
-		_, err = executeFFmpeg(smallcmd)
-		if err != nil {
-			return fmt.Errorf("Failed to execute ffmpeg %s: %w", fullpath, err)
-		}
-
-		_, err = os.Stat(smallpath)
-		if err != nil {
-			err = os.WriteFile(smallpath, []byte{}, 0644)
-			if err != nil {
-				return fmt.Errorf("Failed to write small thumbnail %s: %w", fullpath, err)
-			}
-		}
-
-	}
-
-	return nil
-
-}
-*/
\ No newline at end of file
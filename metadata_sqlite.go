@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite store updates the rows of changed entries only
+//
+// Each entry is stored as its json so that new fields of Metadata need no schema change.
+// On the first open the existing *.json caches are migrated.
+//
+// Versions
+//   1  dirs and metadata
+//   2  named playlists of dirs
+//   3  play events
+
+const METADATA_SQLITE_DB = "metadata.sqlite3"
+const METADATA_SQLITE_VERSION = 3
+
+type sqliteMetadataStore struct {
+	db *sql.DB
+}
+
+// Play events are kept in the same db
+var _ PlaysStore = (*sqliteMetadataStore)(nil)
+
+func NewSqliteMetadataStore(dbPath string) (*sqliteMetadataStore, error) {
+
+	db, err := sql.Open("sqlite3", dbPath + "?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // single writer
+
+	store := &sqliteMetadataStore{db}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if version < METADATA_SQLITE_VERSION {
+		err = store.init(version)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Failed to initialize %s: %w", dbPath, err)
+		}
+	}
+
+	return store, nil
+
+}
+
+// init creates or upgrades the tables from the version and migrates the json caches
+func (store *sqliteMetadataStore) init(version int) error {
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if version < 1 {
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS dirs (
+			dir TEXT PRIMARY KEY,
+			playlist TEXT NOT NULL DEFAULT '[]'
+		);
+		CREATE TABLE IF NOT EXISTS metadata (
+			dir TEXT NOT NULL,
+			base TEXT NOT NULL,
+			meta TEXT NOT NULL,
+			PRIMARY KEY (dir, base)
+		);`)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 2 {
+		_, err = tx.Exec("ALTER TABLE dirs ADD COLUMN playlists TEXT NOT NULL DEFAULT '[]'")
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 3 {
+		_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS plays (
+			id INTEGER PRIMARY KEY,
+			play TEXT NOT NULL
+		);`)
+		if err != nil {
+			return err
+		}
+
+		plays, err := (&jsonPlaysStore{}).LoadPlays()
+		if err != nil {
+			return err
+		}
+		for _, play := range plays {
+			err = store.addPlay(tx, play)
+			if err != nil {
+				return err
+			}
+		}
+		if len(plays) > 0 {
+			logInfo("Migrated", len(plays), "play events to", METADATA_SQLITE_DB)
+		}
+	}
+
+	// Migrate
+	bodies := make(map[string]*MetadataBody)
+	if version < 1 {
+		bodies, err = (&jsonMetadataStore{}).Load()
+		if err != nil {
+			return err
+		}
+	}
+
+	for dir, body := range bodies {
+		if body.MetaMap == nil {
+			continue
+		}
+		bases := make([]string, 0, len(body.MetaMap))
+		for base := range body.MetaMap {
+			bases = append(bases, base)
+		}
+		err = store.save(tx, dir, body, true, bases)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", METADATA_SQLITE_VERSION))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if version < 1 {
+		logInfo("Migrated", len(bodies), "json caches to", METADATA_SQLITE_DB)
+	}
+
+	return nil
+
+}
+
+func (store *sqliteMetadataStore) Load() (map[string]*MetadataBody, error) {
+
+	bodies := make(map[string]*MetadataBody)
+
+	rows, err := store.db.Query("SELECT dir, playlist, playlists FROM dirs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var dir, playlist, playlists string
+		err = rows.Scan(&dir, &playlist, &playlists)
+		if err != nil {
+			return nil, err
+		}
+
+		body := &MetadataBody{
+			MetaMap:	make(MetadataMap),
+			Playlist:	make([]string, 0),
+			Playlists:	make([]*Playlist, 0),
+		}
+		err = json.Unmarshal([]byte(playlist), &body.Playlist)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed playlist of %s: %w", dir, err)
+		}
+		err = json.Unmarshal([]byte(playlists), &body.Playlists)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed playlists of %s: %w", dir, err)
+		}
+		bodies[filepath.FromSlash(dir)] = body
+
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = store.db.Query("SELECT dir, base, meta FROM metadata")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var dir, base, meta string
+		err = rows.Scan(&dir, &base, &meta)
+		if err != nil {
+			return nil, err
+		}
+
+		body, ok := bodies[filepath.FromSlash(dir)]
+		if !ok {
+			continue
+		}
+		m := &Metadata{}
+		err = json.Unmarshal([]byte(meta), m)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed metadata of %s %s: %w", dir, base, err)
+		}
+		body.MetaMap[base] = m
+
+	}
+
+	return bodies, rows.Err()
+
+}
+
+func (store *sqliteMetadataStore) save(tx *sql.Tx, dir string, body *MetadataBody, playlist bool, bases []string) error {
+
+	dir = filepath.ToSlash(dir)
+
+	_, err := tx.Exec("INSERT OR IGNORE INTO dirs (dir) VALUES (?)", dir)
+	if err != nil {
+		return err
+	}
+
+	for _, base := range bases {
+
+		meta, ok := body.MetaMap[base]
+		if !ok {
+			_, err = tx.Exec("DELETE FROM metadata WHERE dir = ? AND base = ?", dir, base)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO metadata (dir, base, meta) VALUES (?, ?, ?)", dir, base, string(data))
+		if err != nil {
+			return err
+		}
+
+	}
+
+	if playlist {
+		data, err := json.Marshal(body.Playlist)
+		if err != nil {
+			return err
+		}
+		pls := body.Playlists
+		if pls == nil {
+			pls = make([]*Playlist, 0)
+		}
+		data1, err := json.Marshal(pls)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE dirs SET playlist = ?, playlists = ? WHERE dir = ?", string(data), string(data1), dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (store *sqliteMetadataStore) Save(dir string, body *MetadataBody, data []byte, playlist bool, bases []string) error {
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = store.save(tx, dir, body, playlist, bases)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+func (store *sqliteMetadataStore) addPlay(tx *sql.Tx, play *PlayEvent) error {
+
+	data, err := json.Marshal(play)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO plays (play) VALUES (?)", string(data))
+	return err
+
+}
+
+func (store *sqliteMetadataStore) AddPlay(play *PlayEvent) error {
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = store.addPlay(tx, play)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+func (store *sqliteMetadataStore) ReplacePlays(plays []*PlayEvent) error {
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM plays")
+	if err != nil {
+		return err
+	}
+	for _, play := range plays {
+		err = store.addPlay(tx, play)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+
+}
+
+func (store *sqliteMetadataStore) LoadPlays() ([]*PlayEvent, error) {
+
+	plays := make([]*PlayEvent, 0)
+
+	rows, err := store.db.Query("SELECT play FROM plays ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		play := &PlayEvent{}
+		err = json.Unmarshal([]byte(data), play)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed play event: %w", err)
+		}
+		plays = append(plays, play)
+
+	}
+
+	return plays, rows.Err()
+
+}
+
+func (store *sqliteMetadataStore) RenameDir(dir, newDir string) error {
+
+	dir = filepath.ToSlash(dir)
+	newDir = filepath.ToSlash(newDir)
+	prefix := dir + "/"
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"dirs", "metadata"} {
+		// substr and length count characters, not bytes
+		_, err = tx.Exec(
+			"UPDATE " + table + " SET dir = ? || substr(dir, length(?) + 1) " +
+				"WHERE dir = ? OR substr(dir, 1, length(?)) = ?",
+			newDir, dir, dir, prefix, prefix,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+
+}
+
+func (store *sqliteMetadataStore) RemoveDir(dir string) error {
+
+	dir = filepath.ToSlash(dir)
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM metadata WHERE dir = ?", dir)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM dirs WHERE dir = ?", dir)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+func (store *sqliteMetadataStore) Close() error {
+	return store.db.Close()
+}
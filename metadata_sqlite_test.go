@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestSqliteRenameDir(t *testing.T) {
+
+	gAppInfo.MetadataDir = t.TempDir()
+	store, err := NewSqliteMetadataStore(filepath.Join(gAppInfo.MetadataDir, METADATA_SQLITE_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	dirs := []string{
+		"uploads/앨범", "uploads/앨범/하위", "uploads/앨범/하위/더", "uploads/앨범2", "uploads/Café", "uploads/Café/été",
+	}
+	for _, dir := range dirs {
+		body := &MetadataBody{MetaMap: MetadataMap{"a.mp3": &Metadata{Size: 1}}}
+		err = store.Save(dir, body, nil, true, []string{"a.mp3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		dir, newDir string
+	}{
+		{"uploads/앨범", "uploads/새 앨범"},
+		{"uploads/Café", "uploads/Cafe"},
+	}
+	for _, tt := range tests {
+		err = store.RenameDir(tt.dir, tt.newDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bodies, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for dir, body := range bodies {
+		if len(body.MetaMap) != 1 {
+			t.Errorf("%s has %d entries", dir, len(body.MetaMap))
+		}
+		got = append(got, filepath.ToSlash(dir))
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"uploads/Cafe", "uploads/Cafe/été", "uploads/새 앨범", "uploads/새 앨범/하위", "uploads/새 앨범/하위/더", "uploads/앨범2",
+	}
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MetadataStore persists the bodies of MetadataManager, which keeps them in memory
+type MetadataStore interface {
+	// Load returns the stored bodies by dir
+	Load() (map[string]*MetadataBody, error)
+	// Save stores the entries of bases in body, absent ones are removed,
+	// and the playlists of body when playlist is true, data is body as json
+	Save(dir string, body *MetadataBody, data []byte, playlist bool, bases []string) error
+	// RenameDir moves the stored dir and its sub dirs
+	RenameDir(dir, newDir string) error
+	// RemoveDir removes the stored dir, not its sub dirs
+	RemoveDir(dir string) error
+	Close() error
+}
+
+const METADATA_STORE_JSON = "json"
+const METADATA_STORE_SQLITE = "sqlite"
+
+func NewMetadataStore(kind string) (MetadataStore, error) {
+
+	switch kind {
+	case METADATA_STORE_JSON:
+		return &jsonMetadataStore{}, nil
+	case METADATA_STORE_SQLITE:
+		store, err := NewSqliteMetadataStore(filepath.Join(gAppInfo.MetadataDir, METADATA_SQLITE_DB))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("Unknown metadata store %s", kind)
+
+}
+
+// JSON store writes the whole body of a dir as one file on every save
+type jsonMetadataStore struct {
+}
+
+func (store *jsonMetadataStore) parseDirCacheName(jsonBase string) string {
+	jsonBase = strings.TrimSuffix(jsonBase, ".json")
+	return filepath.Join(strings.Split(jsonBase, META_SLASH_IN_FILENAME)...)
+}
+
+func (store *jsonMetadataStore) formatDirCacheName(dir string) string {
+	dir = strings.ReplaceAll(dir, "/", META_SLASH_IN_FILENAME)
+	dir = strings.ReplaceAll(dir, "\\", META_SLASH_IN_FILENAME)
+	return filepath.Join(gAppInfo.MetadataDir, dir) + ".json"
+}
+
+func (store *jsonMetadataStore) Load() (map[string]*MetadataBody, error) {
+
+	jsonPaths, err := filepath.Glob(filepath.Join(gAppInfo.MetadataDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	bodies := make(map[string]*MetadataBody)
+	for _, jsonPath := range jsonPaths {
+
+		data, err := ioReadFile(jsonPath)
+		if err != nil {
+			return nil, err
+		}
+
+		body := &MetadataBody{}
+		err = json.Unmarshal(data, body)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed cache file %s: %w", jsonPath, err)
+		}
+
+		bodies[store.parseDirCacheName(filepath.Base(jsonPath))] = body
+
+	}
+
+	return bodies, nil
+
+}
+
+func (store *jsonMetadataStore) Save(dir string, body *MetadataBody, data []byte, playlist bool, bases []string) error {
+	return ioWriteFile(store.formatDirCacheName(dir), data, 0644)
+}
+
+func (store *jsonMetadataStore) RenameDir(dir, newDir string) error {
+
+	name := filepath.Base(store.formatDirCacheName(dir))
+	stem := strings.TrimSuffix(name, ".json")
+	newStem := strings.TrimSuffix(filepath.Base(store.formatDirCacheName(newDir)), ".json")
+
+	dentries, err := ioReadDir(gAppInfo.MetadataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, dentry := range dentries {
+		name1 := dentry.Name()
+		if name1 != name && !strings.HasPrefix(name1, stem + META_SLASH_IN_FILENAME) {
+			continue
+		}
+		err = os.Rename(
+			filepath.Join(gAppInfo.MetadataDir, name1),
+			filepath.Join(gAppInfo.MetadataDir, newStem + name1[len(stem):]),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (store *jsonMetadataStore) RemoveDir(dir string) error {
+
+	err := ioRemove(store.formatDirCacheName(dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+
+}
+
+func (store *jsonMetadataStore) Close() error {
+	return nil
+}
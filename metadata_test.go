@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGetMetadataSidecars(t *testing.T) {
+
+	gAppInfo.MetadataDir = t.TempDir()
+	dir := filepath.Join("uploads", "album")
+	must(os.MkdirAll(filepath.Join(gAppInfo.MetadataDir, dir), 0755))
+
+	files := []string{
+		"a.mp4.json", "a.mp4.webp", "a.mp4_small.webp", "a.mp4_sprite.webp",
+		// Other files whose names begin with a.mp4
+		"a.mp4.bak.json", "a.mp4 (1).webp", "a.mp4.json.part",
+		"b.flac.json", "b.flac_waveform.json",
+		"c.heic_display.jpg",
+	}
+	for _, name := range files {
+		must(os.WriteFile(filepath.Join(gAppInfo.MetadataDir, dir, name), []byte("{}"), 0644))
+	}
+	// Dir of the same name is not a sidecar
+	must(os.MkdirAll(filepath.Join(gAppInfo.MetadataDir, dir, "d.jpg.webp"), 0755))
+
+	tests := []struct {
+		base	string
+		want	[]string
+	}{
+		{"a.mp4", []string{META_EXT_TXT, META_EXT_THUMB, META_EXT_THUMB_SMALL, META_EXT_SPRITE}},
+		{"a.mp4.bak", []string{META_EXT_TXT}},
+		{"b.flac", []string{META_EXT_TXT, META_EXT_WAVEFORM}},
+		{"c.heic", []string{META_EXT_DISPLAY}},
+		{"d.jpg", []string{}},
+		{"a", []string{}},
+	}
+
+	for _, tt := range tests {
+		got, err := getMetadataSidecars(dir, tt.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s got %q, want %q", tt.base, got, want)
+		}
+	}
+
+}
+
+// newTestMetadataManager points the dirs into a temp dir which is also the working dir,
+// and registers the upload dir
+func newTestMetadataManager(t *testing.T) {
+
+	root := t.TempDir()
+	wd, err := os.Getwd()
+	must(err)
+	must(os.Chdir(root))
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+
+	gAppInfo.UploadDir = filepath.Join(".", UPLOADS)
+	gAppInfo.MetadataDir = filepath.Join(root, METADATA_DIR)
+	must(os.MkdirAll(gAppInfo.UploadDir, 0755))
+	must(os.MkdirAll(gAppInfo.MetadataDir, 0755))
+
+	gMetadataManager = NewMetadataManager(&jsonMetadataStore{})
+	gMetadataManager.AddDir(gAppInfo.UploadDir)
+	// Bakes are queued but not run
+	gMetadataManager.baker = NewMetadataBaker(gMetadataManager, 0)
+	gPlayHistory = NewPlayHistory(&jsonPlaysStore{})
+
+}
+
+func TestMetadataFillCrcOfChangedFile(t *testing.T) {
+
+	fullpath := filepath.Join(t.TempDir(), "a.mp4")
+	write := func(data string, modTime time.Time) os.FileInfo {
+		must(os.WriteFile(fullpath, []byte(data), 0644))
+		must(os.Chtimes(fullpath, modTime, modTime))
+		info, err := os.Stat(fullpath)
+		must(err)
+		return info
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	meta := &Metadata{}
+	meta.fill(fullpath, write("first", modTime))
+	first := meta.Crc32
+	key := meta.contentKey()
+
+	// Same size and time
+	if meta.fill(fullpath, write("first", modTime)); meta.Crc32 != first {
+		t.Errorf("crc %s of unchanged file, want %s", meta.Crc32, first)
+	}
+
+	// Same size, changed in place
+	if !meta.fill(fullpath, write("other", modTime.Add(time.Second))) {
+		t.Error("change is not reported")
+	}
+	if meta.Crc32 == first || meta.Crc32 != getCRC32OfBytes([]byte("other")) {
+		t.Errorf("crc %s of changed file", meta.Crc32)
+	}
+	if meta.contentKey() == key {
+		t.Errorf("content key %s is kept", key)
+	}
+
+	meta.fill(fullpath, write("longer", modTime.Add(time.Second)))
+	if meta.Crc32 != getCRC32OfBytes([]byte("longer")) || meta.contentKey() != meta.Crc32 + "_6" {
+		t.Errorf("crc %s, key %s of resized file", meta.Crc32, meta.contentKey())
+	}
+
+}
+
+// addTestFile writes the file in the album and sets its metadata, registering the album
+func addTestFile(t *testing.T, album, base string) string {
+
+	dir, err := getAlbumDir(album)
+	must(err)
+	must(os.MkdirAll(dir, 0755))
+	gMetadataManager.AddDir(dir)
+
+	fullpath := filepath.Join(dir, base)
+	must(os.WriteFile(fullpath, []byte(album + "/" + base), 0644))
+	info, err := os.Stat(fullpath)
+	must(err)
+	must(gMetadataManager.SetMetadata(dir, base, info, getCRC32OfBytes([]byte(album + "/" + base))))
+
+	return dir
+
+}
+
+func TestMoveAndRemoveFileInOtherPlaylists(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dirA := addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a", "y.mp3")
+	dirB := addTestFile(t, "b", "z.mp3")
+	dirC := addTestFile(t, "c", "w.mp3")
+
+	entries := []PlaylistEntry{{"a", "x.mp3"}, {"c", "w.mp3"}, {"a", "y.mp3"}}
+	must(gMetadataManager.CreatePlaylist(dirC, "mix", entries))
+	must(gMetadataManager.CreatePlaylist(dirA, "own", entries[:1]))
+
+	playlist := func(dir, name string) []PlaylistEntry {
+		pls, err := gMetadataManager.Playlists(dir)
+		must(err)
+		for _, pl := range pls {
+			if pl.Name == name {
+				return pl.Entries
+			}
+		}
+		t.Fatalf("playlist %s not found", name)
+		return nil
+	}
+
+	newBase, err := gMetadataManager.MoveFile(dirA, "x.mp3", dirB, "x.mp3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlaylistEntry{{"b", newBase}, {"c", "w.mp3"}, {"a", "y.mp3"}}
+	if got := playlist(dirC, "mix"); !slices.Equal(got, want) {
+		t.Errorf("after move got %v, want %v", got, want)
+	}
+	if got := playlist(dirA, "own"); !slices.Equal(got, want[:1]) {
+		t.Errorf("own playlist after move got %v, want %v", got, want[:1])
+	}
+	if _, ok := gMetadataManager.GetMetadata(dirA, "x.mp3"); ok {
+		t.Error("moved file is left in the source")
+	}
+	// Still editable
+	if err := gMetadataManager.SetPlaylist(dirC, "mix", playlist(dirC, "mix")); err != nil {
+		t.Errorf("SetPlaylist after move err: %v", err)
+	}
+
+	// Copy leaves entries as they are
+	if _, err := gMetadataManager.MoveFile(dirA, "y.mp3", dirB, "y.mp3", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := playlist(dirC, "mix"); !slices.Equal(got, want) {
+		t.Errorf("after copy got %v, want %v", got, want)
+	}
+
+	if err := gMetadataManager.RemoveFile(dirB, newBase); err != nil {
+		t.Fatal(err)
+	}
+	want = []PlaylistEntry{{"c", "w.mp3"}, {"a", "y.mp3"}}
+	if got := playlist(dirC, "mix"); !slices.Equal(got, want) {
+		t.Errorf("after remove got %v, want %v", got, want)
+	}
+	if got := playlist(dirA, "own"); len(got) != 0 {
+		t.Errorf("own playlist after remove got %v", got)
+	}
+	if err := gMetadataManager.SetPlaylist(dirC, "mix", playlist(dirC, "mix")); err != nil {
+		t.Errorf("SetPlaylist after remove err: %v", err)
+	}
+
+}
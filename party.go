@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Party mode
+//
+// GET /ws/party?room=R&device=D[&lead=1] joins the room R, the first member or one with lead leads
+//
+// Messages are json of {"type": T, T: value} as in /ws/ffmpeg
+//
+//   time      client -> server {"client": ms}, replied with "server" set to the server time
+//             so that the client estimates its clock offset from the round trip
+//   state     leader -> server -> followers, the playback of the leader,
+//             "at" is the server time in ms when the position was read
+//   lead      client -> server, takes the lead
+//   members   server -> clients, the leader and devices in the room
+//   error     server -> client
+//
+// Followers seek to position + (server now - at) while playing.
+
+const PARTY_SEND_BUFFER = 16
+const PARTY_PING_INTERVAL = time.Second * 20
+const PARTY_READ_TIMEOUT = time.Second * 60
+const PARTY_WRITE_TIMEOUT = time.Second * 10
+const PARTY_CLOCK_TOLERANCE = 5000 // ms
+const QUERY_ROOM = "room"
+const QUERY_LEAD = "lead"
+
+type PartyTime struct {
+	Client		int64		`json:"client"`
+	Server		int64		`json:"server"`
+}
+
+type PartyState struct {
+	Album		string		`json:"album"`
+	Base		string		`json:"base"`
+	Position	float64		`json:"position"` // seconds
+	Playing		bool		`json:"playing"`
+	At			int64		`json:"at"` // server unix ms
+}
+
+type PartyMembers struct {
+	Leader		string		`json:"leader"`
+	Devices		[]string	`json:"devices"`
+}
+
+type partyMessage struct {
+	Type		string			`json:"type"`
+	Time		*PartyTime		`json:"time,omitempty"`
+	State		*PartyState		`json:"state,omitempty"`
+	Members		*PartyMembers	`json:"members,omitempty"`
+	Error		string			`json:"error,omitempty"`
+}
+
+type partyMember struct {
+	device		string
+	send		chan []byte
+	closed		bool
+}
+
+type partyRoom struct {
+	members		[]*partyMember // in order of joining
+	leader		*partyMember
+	state		*PartyState
+}
+
+type PartyHub struct {
+	rooms		map[string] *partyRoom
+	mu			sync.Mutex
+}
+
+var gPartyHub = NewPartyHub()
+
+func NewPartyHub() *PartyHub {
+
+	hub := &PartyHub{}
+
+	hub.rooms = make(map[string]*partyRoom)
+
+	return hub
+
+}
+
+func partyNow() int64 {
+	return time.Now().UnixMilli()
+}
+
+func marshalPartyMessage(msg partyMessage) []byte {
+	data, err := json.Marshal(msg)
+	must(err)
+	return data
+}
+
+// sendLocked must be called while holding hub.mu, drops the member that cannot keep up
+func (hub *PartyHub) sendLocked(member *partyMember, data []byte) {
+
+	if member.closed {
+		return
+	}
+
+	select {
+	case member.send <- data:
+	default:
+		member.closed = true
+		close(member.send)
+	}
+
+}
+
+// broadcastMembersLocked must be called while holding hub.mu
+func (hub *PartyHub) broadcastMembersLocked(room *partyRoom) {
+
+	members := &PartyMembers{Devices: make([]string, 0, len(room.members))}
+	if room.leader != nil {
+		members.Leader = room.leader.device
+	}
+	for _, member := range room.members {
+		members.Devices = append(members.Devices, member.device)
+	}
+
+	data := marshalPartyMessage(partyMessage{Type: "members", Members: members})
+	for _, member := range room.members {
+		hub.sendLocked(member, data)
+	}
+
+}
+
+func (hub *PartyHub) join(name, device string, lead bool) (*partyRoom, *partyMember) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	room, ok := hub.rooms[name]
+	if !ok {
+		room = &partyRoom{}
+		hub.rooms[name] = room
+	}
+
+	member := &partyMember{
+		device:	device,
+		send:	make(chan []byte, PARTY_SEND_BUFFER),
+	}
+	room.members = append(room.members, member)
+	if lead || room.leader == nil {
+		room.leader = member
+	}
+
+	hub.broadcastMembersLocked(room)
+	if room.state != nil && room.leader != member {
+		hub.sendLocked(member, marshalPartyMessage(partyMessage{Type: "state", State: room.state}))
+	}
+
+	return room, member
+
+}
+
+func (hub *PartyHub) leave(name string, room *partyRoom, member *partyMember) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for i, member1 := range room.members {
+		if member1 == member {
+			room.members = append(room.members[:i], room.members[i + 1:]...)
+			break
+		}
+	}
+	if !member.closed {
+		member.closed = true
+		close(member.send)
+	}
+
+	if len(room.members) == 0 {
+		delete(hub.rooms, name)
+		return
+	}
+
+	// The earliest joined leads next
+	if room.leader == member {
+		room.leader = room.members[0]
+	}
+	hub.broadcastMembersLocked(room)
+
+}
+
+func (hub *PartyHub) handle(room *partyRoom, member *partyMember, msg partyMessage) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	switch msg.Type {
+	case "time":
+		if msg.Time == nil {
+			break
+		}
+		msg.Time.Server = partyNow()
+		hub.sendLocked(member, marshalPartyMessage(msg))
+		return
+
+	case "lead":
+		room.leader = member
+		hub.broadcastMembersLocked(room)
+		return
+
+	case "state":
+		if room.leader != member {
+			hub.sendLocked(member, marshalPartyMessage(partyMessage{Type: "error", Error: "Not the leader"}))
+			return
+		}
+		if msg.State == nil {
+			break
+		}
+		// Read by the leader on its estimate of the server clock
+		now := partyNow()
+		if msg.State.At < now - PARTY_CLOCK_TOLERANCE || msg.State.At > now + PARTY_CLOCK_TOLERANCE {
+			msg.State.At = now
+		}
+		room.state = msg.State
+
+		data := marshalPartyMessage(partyMessage{Type: "state", State: room.state})
+		for _, member1 := range room.members {
+			if member1 != member {
+				hub.sendLocked(member1, data)
+			}
+		}
+		return
+	}
+
+	hub.sendLocked(member, marshalPartyMessage(partyMessage{Type: "error", Error: "Malformed message"}))
+
+}
+
+func partyHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	name := query.Get(QUERY_ROOM)
+	device := query.Get(QUERY_DEVICE)
+	if name == "" || device == "" {
+		logHTTPRequest(r, -1, "Party without room or device")
+		http.Error(w, "Room and device are required", http.StatusBadRequest)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logHTTPRequest(r, 599, "Party upgrade error:", err)
+		return
+	}
+	defer wsConn.Close()
+
+	room, member := gPartyHub.join(name, device, query.Get(QUERY_LEAD) == "1")
+	defer gPartyHub.leave(name, room, member)
+	logHTTPRequest(r, -1, "Party", device, "joined", name)
+
+	// Writer, the only one writing to the conn
+	go func() {
+		ticker := time.NewTicker(PARTY_PING_INTERVAL)
+		defer ticker.Stop()
+		defer wsConn.Close()
+		for {
+			select {
+			case data, ok := <-member.send:
+				if !ok {
+					return
+				}
+				wsConn.SetWriteDeadline(time.Now().Add(PARTY_WRITE_TIMEOUT))
+				if err := wsConn.WriteMessage(websocket.TextMessage, data); err != nil {
+					return
+				}
+			case <-ticker.C:
+				wsConn.SetWriteDeadline(time.Now().Add(PARTY_WRITE_TIMEOUT))
+				if err := wsConn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Reader
+	wsConn.SetReadDeadline(time.Now().Add(PARTY_READ_TIMEOUT))
+	wsConn.SetPongHandler(func(string) error {
+		return wsConn.SetReadDeadline(time.Now().Add(PARTY_READ_TIMEOUT))
+	})
+	for {
+		msgType, data, err := wsConn.ReadMessage()
+		if err != nil {
+			logHTTPRequest(r, -1, "Party", device, "left", name, err)
+			return
+		}
+		wsConn.SetReadDeadline(time.Now().Add(PARTY_READ_TIMEOUT))
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		var msg partyMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			msg = partyMessage{}
+		}
+		gPartyHub.handle(room, member, msg)
+	}
+
+}
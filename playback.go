@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Playback state shared between devices
+//
+// GET /api/playback?listener=L                 returns the states of L in all albums, last updated first
+// GET /api/playback?listener=L&album=A         returns the state of L in A
+// PUT /api/playback?listener=L&album=A         body is the state, returns the stored state
+//
+// A listener is whoever resumes the playback, the client sends a persistent id of its own
+// which can be shared between devices. States of listeners don't overwrite each other.
+// Updated is stamped by the server in unix milliseconds when the state arrives so that the last
+// write wins whatever the clocks of the devices are, the one in the body is ignored.
+// Other devices are notified by the playback event.
+
+const PLAYBACK_JSON = "playback.json"
+const PLAYBACK_REPEAT_OFF = "off"
+const PLAYBACK_REPEAT_ALL = "all"
+const PLAYBACK_REPEAT_ONE = "one"
+const EVENT_PLAYBACK = "playback"
+const QUERY_LISTENER = "listener"
+
+type PlaybackState struct {
+	Listener	string		`json:"listener"`
+	Album		string		`json:"album"`
+	Base		string		`json:"base"`
+	Position	float64		`json:"position"` // seconds
+	Seed		*int64		`json:"seed"` // null when not shuffled
+	Repeat		string		`json:"repeat"`
+	Queue		[]string	`json:"queue"`
+	Device		string		`json:"device"`
+	Updated		int64		`json:"updated"`
+}
+
+type playbackKey struct {
+	listener	string
+	album		string
+}
+
+type PlaybackManager struct {
+	states		map[playbackKey] *PlaybackState
+	mu			sync.Mutex
+}
+
+var gPlayback *PlaybackManager
+
+func NewPlaybackManager() *PlaybackManager {
+
+	pm := &PlaybackManager{}
+
+	pm.states = make(map[playbackKey]*PlaybackState)
+
+	return pm
+
+}
+
+// Not in metadata dir where *.json are dir caches
+func (pm *PlaybackManager) jsonPath() string {
+	return PLAYBACK_JSON
+}
+
+func (pm *PlaybackManager) Load() error {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	data, err := ioReadFile(pm.jsonPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	states := make([]*PlaybackState, 0)
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		// Kept by album only before listeners
+		var legacy map[string]*PlaybackState
+		if json.Unmarshal(data, &legacy) != nil {
+			return err
+		}
+		logWarn("Dropped", len(legacy), "playback states without listener")
+	}
+	for _, state := range states {
+		pm.states[playbackKey{state.Listener, state.Album}] = state
+	}
+
+	return nil
+
+}
+
+// store must be called while holding pm.mu
+func (pm *PlaybackManager) store() {
+
+	states := make([]*PlaybackState, 0, len(pm.states))
+	for _, state := range pm.states {
+		states = append(states, state)
+	}
+	data, err := json.Marshal(states)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioWriteFile(pm.jsonPath(), data, 0644)
+	if err != nil {
+		logError("Failed to write playback states err:", err)
+	}
+
+}
+
+func (pm *PlaybackManager) Get(listener, album string) (PlaybackState, bool) {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	state, ok := pm.states[playbackKey{listener, filepath.ToSlash(cleanAlbumPath(album))}]
+	if !ok {
+		return PlaybackState{}, false
+	}
+
+	return *state, true
+
+}
+
+// All returns the states of the listener
+func (pm *PlaybackManager) All(listener string) []PlaybackState {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	states := make([]PlaybackState, 0)
+	for key, state := range pm.states {
+		if key.listener == listener {
+			states = append(states, *state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Updated > states[j].Updated
+	})
+
+	return states
+
+}
+
+// Set stores the state stamping Updated, returns the stored state
+func (pm *PlaybackManager) Set(state PlaybackState) (PlaybackState, error) {
+
+	if state.Listener == "" {
+		return PlaybackState{}, fmt.Errorf("Listener is required")
+	}
+	dir, err := getAlbumDir(state.Album)
+	if err != nil {
+		return PlaybackState{}, err
+	}
+	if _, ok := gMetadataManager.getCache(dir); !ok {
+		return PlaybackState{}, fmt.Errorf("Album not found %s", state.Album)
+	}
+	if state.Base != "" {
+		meta, ok := gMetadataManager.GetMetadata(dir, state.Base)
+		if !ok || !isAudio(meta.MimeType) {
+			return PlaybackState{}, fmt.Errorf("Not an audio file %s", state.Base)
+		}
+	}
+	if math.IsNaN(state.Position) || math.IsInf(state.Position, 0) || state.Position < 0 {
+		return PlaybackState{}, fmt.Errorf("Invalid position %v", state.Position)
+	}
+	switch state.Repeat {
+	case "":
+		state.Repeat = PLAYBACK_REPEAT_ALL
+	case PLAYBACK_REPEAT_OFF, PLAYBACK_REPEAT_ALL, PLAYBACK_REPEAT_ONE:
+	default:
+		return PlaybackState{}, fmt.Errorf("Invalid repeat %q", state.Repeat)
+	}
+	if state.Queue == nil {
+		state.Queue = make([]string, 0)
+	}
+	state.Album = filepath.ToSlash(cleanAlbumPath(state.Album))
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	// Increasing even if the server clock goes back
+	key := playbackKey{state.Listener, state.Album}
+	state.Updated = time.Now().UnixMilli()
+	if stored, ok := pm.states[key]; ok && stored.Updated >= state.Updated {
+		state.Updated = stored.Updated + 1
+	}
+	pm.states[key] = &state
+	pm.store()
+
+	gEventHub.Publish(Event{
+		Type:		EVENT_PLAYBACK,
+		Album:		state.Album,
+		Device:		state.Device,
+		Listener:	state.Listener,
+	})
+
+	return state, nil
+
+}
+
+func apiPlayback(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	listener := query.Get(QUERY_LISTENER)
+	if listener == "" {
+		logHTTPRequest(r, -1, "No listener for playback")
+		http.Error(w, "Listener is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+		if !query.Has(QUERY_ALBUM) {
+			serveJson(w, r, gPlayback.All(listener))
+			return
+		}
+
+		state, ok := gPlayback.Get(listener, query.Get(QUERY_ALBUM))
+		if !ok {
+			http.Error(w, "No playback state", http.StatusNotFound)
+			return
+		}
+		serveJson(w, r, state)
+
+	case http.MethodPut:
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to read body", err)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		var state PlaybackState
+		if err := json.Unmarshal(data, &state); err != nil {
+			logHTTPRequest(r, -1, "Failed to parse json", err)
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		state.Listener = listener
+		state.Album = query.Get(QUERY_ALBUM)
+
+		stored, err := gPlayback.Set(state)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to set playback err:", err)
+			http.Error(w, "Invalid playback state", http.StatusBadRequest)
+			return
+		}
+		serveJson(w, r, stored)
+
+	default:
+		logHTTPRequest(r, -1, "Invalid method for playback")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlaybackListeners(t *testing.T) {
+
+	newTestMetadataManager(t)
+	addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a", "y.mp3")
+	addTestFile(t, "b", "z.mp3")
+
+	pm := NewPlaybackManager()
+	set := func(listener, album, base string, position float64) {
+		t.Helper()
+		_, err := pm.Set(PlaybackState{Listener: listener, Album: album, Base: base, Position: position})
+		must(err)
+	}
+	set("l1", "a", "x.mp3", 10)
+	set("l2", "a", "y.mp3", 20)
+	set("l1", "b", "z.mp3", 30)
+
+	if state, ok := pm.Get("l1", "a"); !ok || state.Base != "x.mp3" || state.Position != 10 {
+		t.Errorf("l1 state %+v", state)
+	}
+	if state, ok := pm.Get("l2", "/a/"); !ok || state.Base != "y.mp3" || state.Position != 20 {
+		t.Errorf("l2 state %+v", state)
+	}
+	if _, ok := pm.Get("l2", "b"); ok {
+		t.Error("l2 got the state of l1")
+	}
+	if states := pm.All("l1"); len(states) != 2 || states[0].Updated < states[1].Updated || states[0].Album == states[1].Album {
+		t.Errorf("l1 states %+v", states)
+	}
+	if _, err := pm.Set(PlaybackState{Album: "a", Base: "x.mp3"}); err == nil {
+		t.Error("set without listener")
+	}
+
+	pm1 := NewPlaybackManager()
+	must(pm1.Load())
+	if state, ok := pm1.Get("l2", "a"); !ok || state.Base != "y.mp3" {
+		t.Errorf("loaded l2 state %+v", state)
+	}
+	if states := pm1.All("l1"); len(states) != 2 {
+		t.Errorf("loaded l1 states %+v", states)
+	}
+
+	// Kept by album only before listeners
+	must(os.WriteFile(PLAYBACK_JSON, []byte(`{"a":{"album":"a","base":"x.mp3","position":1}}`), 0644))
+	pm2 := NewPlaybackManager()
+	must(pm2.Load())
+	if states := pm2.All(""); len(states) != 0 {
+		t.Errorf("legacy states %+v", states)
+	}
+
+}
+
+func TestApiPlaybackNeedsListener(t *testing.T) {
+
+	newTestMetadataManager(t)
+	addTestFile(t, "a", "x.mp3")
+	gPlayback = NewPlaybackManager()
+
+	put := func(query string) int {
+		r := httptest.NewRequest(http.MethodPut, "/api/playback?" + query, strings.NewReader(`{"base":"x.mp3","position":5}`))
+		w := httptest.NewRecorder()
+		apiPlayback(w, r)
+		return w.Code
+	}
+
+	if code := put("album=a"); code != http.StatusBadRequest {
+		t.Errorf("without listener status %d", code)
+	}
+	if code := put("album=a&listener=l1"); code != http.StatusOK {
+		t.Errorf("status %d", code)
+	}
+	if state, ok := gPlayback.Get("l1", "a"); !ok || state.Listener != "l1" || state.Position != 5 {
+		t.Errorf("state %+v", state)
+	}
+
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Named playlists
+//
+// MetadataBody.Playlist is the "auto" playlist to which new audio files are appended.
+// The others are in MetadataBody.Playlists and can reference tracks in other albums.
+//
+// GET    /api/playlists?album=A                      lists playlists including auto
+// POST   /api/playlists?album=A&name=P               creates P, body is optional entries
+// PUT    /api/playlists?album=A&name=P               replaces the entries of P for reordering, body is entries
+// PUT    /api/playlists?album=A&name=P&rename=Q      renames P to Q
+// DELETE /api/playlists?album=A&name=P               deletes P
+//
+// Entries are [{"album": "B", "base": "track.mp3"}, ...]; entries of the auto playlist must be in A.
+// Entries of tracks removed or moved through the APIs are removed or moved in every album,
+// those of tracks removed otherwise are removed in their album. Entries follow renamed albums.
+
+const PLAYLIST_AUTO = "auto"
+const QUERY_RENAME = "rename"
+
+type PlaylistEntry struct {
+	Album		string		`json:"album"`
+	Base		string		`json:"base"`
+}
+
+type Playlist struct {
+	Name		string			`json:"name"`
+	Entries		[]PlaylistEntry	`json:"entries"`
+}
+
+func validatePlaylistName(name string) error {
+
+	if strings.TrimSpace(name) == "" || name == PLAYLIST_AUTO {
+		return fmt.Errorf("Invalid playlist name %q", name)
+	}
+
+	return nil
+
+}
+
+// findPlaylist must be called while holding cache.bodyMu
+func (cache *metadataCache) findPlaylist(name string) int {
+	return slices.IndexFunc(cache.body.Playlists, func(pl *Playlist) bool {
+		return pl.Name == name
+	})
+}
+
+// checkPlaylistEntries checks every entry is an audio file
+func (mgr *MetadataManager) checkPlaylistEntries(entries []PlaylistEntry) error {
+
+	for _, entry := range entries {
+
+		dir, err := getAlbumDir(entry.Album)
+		if err != nil {
+			return err
+		}
+		cache, ok := mgr.getCache(dir)
+		if !ok {
+			return fmt.Errorf("Album not found %s", entry.Album)
+		}
+
+		cache.bodyMu.Lock()
+		meta, ok := cache.body.MetaMap[entry.Base]
+		audio := ok && isAudio(meta.MimeType)
+		cache.bodyMu.Unlock()
+
+		if !ok {
+			return fmt.Errorf("File doesn't exist %s", entry.Base)
+		}
+		if !audio {
+			return fmt.Errorf("Not an audio file %s", entry.Base)
+		}
+
+	}
+
+	return nil
+
+}
+
+func (mgr *MetadataManager) Playlists(dir string) ([]Playlist, error) {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return nil, fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	album := getAlbumOfDir(dir)
+	auto := Playlist{PLAYLIST_AUTO, make([]PlaylistEntry, 0, len(cache.body.Playlist))}
+	for _, base := range cache.body.Playlist {
+		auto.Entries = append(auto.Entries, PlaylistEntry{album, base})
+	}
+
+	pls := []Playlist{auto}
+	for _, pl := range cache.body.Playlists {
+		pls = append(pls, Playlist{pl.Name, slices.Clone(pl.Entries)})
+	}
+
+	return pls, nil
+
+}
+
+func (mgr *MetadataManager) CreatePlaylist(dir, name string, entries []PlaylistEntry) error {
+
+	if err := validatePlaylistName(name); err != nil {
+		return err
+	}
+	if err := mgr.checkPlaylistEntries(entries); err != nil {
+		return err
+	}
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	if cache.findPlaylist(name) >= 0 {
+		return fmt.Errorf("Playlist already exists %s", name)
+	}
+
+	cache.body.Playlists = append(cache.body.Playlists, &Playlist{name, entries})
+	cache.save(true)
+
+	return nil
+
+}
+
+// SetPlaylist replaces the entries of the playlist
+func (mgr *MetadataManager) SetPlaylist(dir, name string, entries []PlaylistEntry) error {
+
+	if name == PLAYLIST_AUTO {
+		album := getAlbumOfDir(dir)
+		pl1 := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if cleanAlbumPath(entry.Album) != cleanAlbumPath(album) {
+				return fmt.Errorf("Auto playlist cannot reference other albums")
+			}
+			pl1 = append(pl1, entry.Base)
+		}
+		return mgr.EditPlaylist(dir, pl1)
+	}
+
+	if err := mgr.checkPlaylistEntries(entries); err != nil {
+		return err
+	}
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	i := cache.findPlaylist(name)
+	if i < 0 {
+		return fmt.Errorf("Playlist not found %s", name)
+	}
+
+	cache.body.Playlists[i].Entries = entries
+	cache.save(true)
+
+	return nil
+
+}
+
+func (mgr *MetadataManager) RenamePlaylist(dir, name, newName string) error {
+
+	if err := validatePlaylistName(newName); err != nil {
+		return err
+	}
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	i := cache.findPlaylist(name)
+	if i < 0 {
+		return fmt.Errorf("Playlist not found %s", name)
+	}
+	if cache.findPlaylist(newName) >= 0 {
+		return fmt.Errorf("Playlist already exists %s", newName)
+	}
+
+	cache.body.Playlists[i].Name = newName
+	cache.save(true)
+
+	return nil
+
+}
+
+func (mgr *MetadataManager) DeletePlaylist(dir, name string) error {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return fmt.Errorf("Dir not found")
+	}
+
+	cache.bodyMu.Lock()
+	defer cache.bodyMu.Unlock()
+
+	i := cache.findPlaylist(name)
+	if i < 0 {
+		return fmt.Errorf("Playlist not found %s", name)
+	}
+
+	cache.body.Playlists = slices.Delete(cache.body.Playlists, i, i + 1)
+	cache.save(true)
+
+	return nil
+
+}
+
+// removeFromPlaylists must be called while holding cache.bodyMu,
+// removes the entries of base in the album from the named playlists
+func (cache *metadataCache) removeFromPlaylists(album, base string) bool {
+
+	changed := false
+	for _, pl := range cache.body.Playlists {
+		n := len(pl.Entries)
+		pl.Entries = slices.DeleteFunc(pl.Entries, func(entry PlaylistEntry) bool {
+			return entry.Base == base && cleanAlbumPath(entry.Album) == cleanAlbumPath(album)
+		})
+		changed = changed || n != len(pl.Entries)
+	}
+
+	return changed
+
+}
+
+// moveInPlaylists must be called while holding cache.bodyMu,
+// rewrites the entries of base in the album to newBase in newAlbum
+func (cache *metadataCache) moveInPlaylists(album, base, newAlbum, newBase string) bool {
+
+	changed := false
+	for _, pl := range cache.body.Playlists {
+		for i, entry := range pl.Entries {
+			if entry.Base == base && cleanAlbumPath(entry.Album) == cleanAlbumPath(album) {
+				pl.Entries[i] = PlaylistEntry{newAlbum, newBase}
+				changed = true
+			}
+		}
+	}
+
+	return changed
+
+}
+
+// editOtherPlaylists must be called while holding mgr.updateMu but no cache.bodyMu,
+// edits the named playlists of every cache but except, saving those changed
+func (mgr *MetadataManager) editOtherPlaylists(except *metadataCache, edit func(cache *metadataCache) bool) {
+
+	mgr.cacheMapMu.RLock()
+	caches := make([]*metadataCache, 0, len(mgr.cacheMap))
+	for _, cache := range mgr.cacheMap {
+		if cache != except {
+			caches = append(caches, cache)
+		}
+	}
+	mgr.cacheMapMu.RUnlock()
+
+	for _, cache := range caches {
+		cache.bodyMu.Lock()
+		if edit(cache) {
+			cache.save(true)
+		}
+		cache.bodyMu.Unlock()
+	}
+
+}
+
+// renameAlbumInPlaylists must be called while holding cache.bodyMu,
+// rewrites the entries of the album and its sub albums
+func (cache *metadataCache) renameAlbumInPlaylists(album, newAlbum string) bool {
+
+	album = filepath.ToSlash(cleanAlbumPath(album))
+	newAlbum = filepath.ToSlash(cleanAlbumPath(newAlbum))
+	changed := false
+	for _, pl := range cache.body.Playlists {
+		for i, entry := range pl.Entries {
+			entryAlbum := filepath.ToSlash(cleanAlbumPath(entry.Album))
+			if entryAlbum == album {
+				pl.Entries[i].Album = newAlbum
+				changed = true
+			} else if strings.HasPrefix(entryAlbum, album + "/") {
+				pl.Entries[i].Album = newAlbum + entryAlbum[len(album):]
+				changed = true
+			}
+		}
+	}
+
+	return changed
+
+}
+
+func apiPlaylists(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	dir, err := getAlbumDir(query.Get(QUERY_ALBUM))
+	if err != nil {
+		logHTTPRequest(r, -1, "getAlbumDir err:", err)
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		pls, err := gMetadataManager.Playlists(dir)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to get playlists err:", err)
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		serveJson(w, r, pls)
+		return
+	}
+
+	// ---
+	name := query.Get(QUERY_NAME)
+	entries := make([]PlaylistEntry, 0)
+	if r.Method == http.MethodPost || (r.Method == http.MethodPut && !query.Has(QUERY_RENAME)) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to read body", err)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &entries); err != nil {
+				logHTTPRequest(r, -1, "Failed to parse json", err)
+				http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		err = gMetadataManager.CreatePlaylist(dir, name, entries)
+	case http.MethodPut:
+		if query.Has(QUERY_RENAME) {
+			err = gMetadataManager.RenamePlaylist(dir, name, query.Get(QUERY_RENAME))
+		} else {
+			err = gMetadataManager.SetPlaylist(dir, name, entries)
+		}
+	case http.MethodDelete:
+		err = gMetadataManager.DeletePlaylist(dir, name)
+	default:
+		logHTTPRequest(r, -1, "Invalid method for playlists")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		logHTTPRequest(r, -1, "Failed to edit playlist err:", err)
+		http.Error(w, "Failed to edit playlist", http.StatusBadRequest)
+		return
+	}
+
+	logHTTPRequest(r, -1, "PLAYLIST", r.Method, dir, name)
+
+}
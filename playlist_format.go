@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Playlist files
+//
+// GET  /api/playlistFile?album=A&name=P&format=F    exports P, auto when name is empty
+// POST /api/playlistFile?album=A&name=P&format=F    imports the body into P, creates P if not exists
+//
+// F is one of m3u8, pls and xspf. Exported locations are /view/ urls of this server.
+// Imported locations are matched to the files of A by /view/ url, relative path or file name,
+// the unmatched are returned.
+
+const QUERY_FORMAT = "format"
+
+const PLAYLIST_FORMAT_M3U8 = "m3u8"
+const PLAYLIST_FORMAT_PLS = "pls"
+const PLAYLIST_FORMAT_XSPF = "xspf"
+
+var gPlaylistMimeTypes = map[string]string{
+	PLAYLIST_FORMAT_M3U8:	"audio/x-mpegurl",
+	PLAYLIST_FORMAT_PLS:	"audio/x-scpls",
+	PLAYLIST_FORMAT_XSPF:	"application/xspf+xml",
+}
+
+type playlistTrack struct {
+	Location	string
+	Title		string
+	Creator		string
+	Duration	float64 // seconds, 0 when unknown
+}
+
+type PlaylistImport struct {
+	Matched		int			`json:"matched"`
+	Unmatched	[]string	`json:"unmatched"`
+}
+
+const XSPF_NAMESPACE = "http://xspf.org/ns/0/"
+
+// Matched by the local names so that files without the namespace are parsed too
+type xspfPlaylist struct {
+	XMLName		xml.Name	`xml:"playlist"`
+	Xmlns		string		`xml:"xmlns,attr"`
+	Version		string		`xml:"version,attr"`
+	Title		string		`xml:"title,omitempty"`
+	Tracks		[]xspfTrack	`xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location	string		`xml:"location"`
+	Title		string		`xml:"title,omitempty"`
+	Creator		string		`xml:"creator,omitempty"`
+	Duration	int64		`xml:"duration,omitempty"` // milliseconds
+}
+
+// Export
+
+func formatPlaylist(format, name string, tracks []playlistTrack) ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	switch format {
+	case PLAYLIST_FORMAT_M3U8:
+		buf.WriteString("#EXTM3U\n")
+		for _, track := range tracks {
+			fmt.Fprintf(&buf, "#EXTINF:%d,%s\n%s\n", playlistTrackSeconds(track), playlistTrackTitle(track), track.Location)
+		}
+	case PLAYLIST_FORMAT_PLS:
+		buf.WriteString("[playlist]\n")
+		for i, track := range tracks {
+			fmt.Fprintf(&buf, "File%d=%s\nTitle%d=%s\nLength%d=%d\n",
+				i + 1, track.Location, i + 1, playlistTrackTitle(track), i + 1, playlistTrackSeconds(track))
+		}
+		fmt.Fprintf(&buf, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+	case PLAYLIST_FORMAT_XSPF:
+		pl := xspfPlaylist{Xmlns: XSPF_NAMESPACE, Version: "1", Title: name}
+		for _, track := range tracks {
+			pl.Tracks = append(pl.Tracks, xspfTrack{
+				Location:	track.Location,
+				Title:		track.Title,
+				Creator:	track.Creator,
+				Duration:	int64(math.Round(track.Duration * 1000)),
+			})
+		}
+		data, err := xml.MarshalIndent(pl, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(xml.Header)
+		buf.Write(data)
+		buf.WriteString("\n")
+	default:
+		return nil, fmt.Errorf("Unknown playlist format %q", format)
+	}
+
+	return buf.Bytes(), nil
+
+}
+
+func playlistTrackSeconds(track playlistTrack) int {
+	if track.Duration <= 0 {
+		return -1
+	}
+	return int(math.Round(track.Duration))
+}
+
+// Titles are on a line of m3u and pls
+var gPlaylistLineReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func playlistTrackTitle(track playlistTrack) string {
+	title := track.Title
+	if track.Creator != "" {
+		title = track.Creator + " - " + track.Title
+	}
+	return gPlaylistLineReplacer.Replace(title)
+}
+
+// viewUrl returns the absolute /view/ url of the entry for the host of the request
+func viewUrl(r *http.Request, entry PlaylistEntry) string {
+
+	u := url.URL{
+		Scheme:		"http",
+		Host:		r.Host,
+		Path:		"/view/" + entry.Base,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.RawQuery = url.Values{QUERY_ALBUM: {entry.Album}}.Encode()
+
+	return u.String()
+
+}
+
+func (mgr *MetadataManager) playlistTracks(r *http.Request, entries []PlaylistEntry) []playlistTrack {
+
+	tracks := make([]playlistTrack, 0, len(entries))
+	for _, entry := range entries {
+
+		track := playlistTrack{
+			Location:	viewUrl(r, entry),
+			Title:		strings.TrimSuffix(entry.Base, filepath.Ext(entry.Base)),
+		}
+
+		dir, err := getAlbumDir(entry.Album)
+		if err == nil {
+			if meta, ok := mgr.GetMetadata(dir, entry.Base); ok && meta.Media != nil {
+				track.Duration = meta.Media.Duration
+				if title := meta.Media.Tags["title"]; title != "" {
+					track.Title = title
+				}
+				track.Creator = meta.Media.Tags["artist"]
+			}
+		}
+
+		tracks = append(tracks, track)
+
+	}
+
+	return tracks
+
+}
+
+// Import
+
+// detectPlaylistFormat guesses the format of the file content
+func detectPlaylistFormat(data []byte) string {
+
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\ufeff")))
+
+	if bytes.HasPrefix(data, []byte("<")) {
+		return PLAYLIST_FORMAT_XSPF
+	}
+	if len(data) >= 10 && strings.EqualFold(string(data[:10]), "[playlist]") {
+		return PLAYLIST_FORMAT_PLS
+	}
+
+	return PLAYLIST_FORMAT_M3U8
+
+}
+
+// parsePlaylist returns the locations in the playlist file
+func parsePlaylist(format string, data []byte) ([]string, error) {
+
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	locations := make([]string, 0)
+
+	switch format {
+	case PLAYLIST_FORMAT_M3U8:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				locations = append(locations, line)
+			}
+		}
+		return locations, scanner.Err()
+
+	case PLAYLIST_FORMAT_PLS:
+		// FileN=location, ordered by N
+		files := make(map[int]string)
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+			if !ok || len(key) <= 4 || !strings.EqualFold(key[:4], "file") {
+				continue
+			}
+			n, err := strconv.Atoi(key[4:])
+			if err != nil {
+				continue
+			}
+			files[n] = strings.TrimSpace(value)
+		}
+		keys := make([]int, 0, len(files))
+		for n := range files {
+			keys = append(keys, n)
+		}
+		sort.Ints(keys)
+		for _, n := range keys {
+			locations = append(locations, files[n])
+		}
+		return locations, scanner.Err()
+
+	case PLAYLIST_FORMAT_XSPF:
+		var pl xspfPlaylist
+		err := xml.Unmarshal(data, &pl)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range pl.Tracks {
+			locations = append(locations, strings.TrimSpace(track.Location))
+		}
+		return locations, nil
+	}
+
+	return nil, fmt.Errorf("Unknown playlist format %q", format)
+
+}
+
+// matchPlaylistLocation finds the audio file of the location,
+// files in other albums are matched only when otherAlbums is true
+func (mgr *MetadataManager) matchPlaylistLocation(album, location string, otherAlbums bool) (PlaylistEntry, bool) {
+
+	album = filepath.ToSlash(cleanAlbumPath(album))
+
+	find := func(entryAlbum, base string) (PlaylistEntry, bool) {
+		entryAlbum = filepath.ToSlash(cleanAlbumPath(entryAlbum))
+		if base == "" || base == "." || base == "/" || (!otherAlbums && entryAlbum != album) {
+			return PlaylistEntry{}, false
+		}
+		dir, err := getAlbumDir(entryAlbum)
+		if err != nil {
+			return PlaylistEntry{}, false
+		}
+		meta, ok := mgr.GetMetadata(dir, base)
+		if !ok || !isAudio(meta.MimeType) {
+			return PlaylistEntry{}, false
+		}
+		return PlaylistEntry{entryAlbum, base}, true
+	}
+
+	rel := location
+	if u, err := url.Parse(location); err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "":
+			if strings.HasPrefix(u.Path, "/view/") {
+				if entry, ok := find(u.Query().Get(QUERY_ALBUM), path.Base(u.Path)); ok {
+					return entry, true
+				}
+			}
+			if u.Scheme != "" {
+				rel = u.Path
+			}
+		case "file":
+			rel = u.Path
+		}
+	}
+	rel = strings.ReplaceAll(rel, "\\", "/")
+
+	// Relative path from the album
+	if !path.IsAbs(rel) && !strings.Contains(rel, ":") {
+		clean := path.Clean(rel)
+		if !strings.HasPrefix(clean, "../") {
+			if entry, ok := find(path.Join(album, path.Dir(clean)), path.Base(clean)); ok {
+				return entry, true
+			}
+		}
+	}
+
+	// File name
+	return find(album, path.Base(rel))
+
+}
+
+func (mgr *MetadataManager) ImportPlaylist(dir, name string, locations []string) (PlaylistImport, error) {
+
+	result := PlaylistImport{Unmatched: make([]string, 0)}
+
+	album := getAlbumOfDir(dir)
+	entries := make([]PlaylistEntry, 0, len(locations))
+	for _, location := range locations {
+		entry, ok := mgr.matchPlaylistLocation(album, location, name != PLAYLIST_AUTO)
+		if !ok {
+			result.Unmatched = append(result.Unmatched, location)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	result.Matched = len(entries)
+
+	if name != PLAYLIST_AUTO {
+		pls, err := mgr.Playlists(dir)
+		if err != nil {
+			return result, err
+		}
+		exists := false
+		for _, pl := range pls {
+			exists = exists || pl.Name == name
+		}
+		if !exists {
+			return result, mgr.CreatePlaylist(dir, name, entries)
+		}
+	}
+
+	return result, mgr.SetPlaylist(dir, name, entries)
+
+}
+
+func apiPlaylistFile(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	dir, err := getAlbumDir(query.Get(QUERY_ALBUM))
+	if err != nil {
+		logHTTPRequest(r, -1, "getAlbumDir err:", err)
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+
+	name := query.Get(QUERY_NAME)
+	if name == "" {
+		name = PLAYLIST_AUTO
+	}
+	format := strings.ToLower(query.Get(QUERY_FORMAT))
+
+	switch r.Method {
+	case http.MethodGet:
+
+		if format == "" {
+			format = PLAYLIST_FORMAT_M3U8
+		}
+		mimeType, ok := gPlaylistMimeTypes[format]
+		if !ok {
+			logHTTPRequest(r, -1, "Unknown playlist format", format)
+			http.Error(w, "Unknown format", http.StatusBadRequest)
+			return
+		}
+
+		pls, err := gMetadataManager.Playlists(dir)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to get playlists err:", err)
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		var entries []PlaylistEntry
+		for _, pl := range pls {
+			if pl.Name == name {
+				entries = pl.Entries
+			}
+		}
+		if entries == nil {
+			logHTTPRequest(r, -1, "Playlist not found", name)
+			http.Error(w, "Playlist not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := formatPlaylist(format, name, gMetadataManager.playlistTracks(r, entries))
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to format playlist err:", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+		w.Write(data)
+
+	case http.MethodPost:
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to read body", err)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if format == "" {
+			format = detectPlaylistFormat(data)
+		} else if format == "m3u" {
+			format = PLAYLIST_FORMAT_M3U8
+		}
+
+		locations, err := parsePlaylist(format, data)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to parse playlist err:", err)
+			http.Error(w, "Invalid playlist file", http.StatusBadRequest)
+			return
+		}
+
+		result, err := gMetadataManager.ImportPlaylist(dir, name, locations)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to import playlist err:", err)
+			http.Error(w, "Failed to import playlist", http.StatusBadRequest)
+			return
+		}
+
+		logHTTPRequest(r, -1, "PLAYLIST IMPORT", dir, name, result.Matched, "matched,", len(result.Unmatched), "unmatched")
+		serveJson(w, r, result)
+
+	default:
+		logHTTPRequest(r, -1, "Invalid method for playlist file")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePlaylist(t *testing.T) {
+
+	tests := []struct {
+		name	string
+		data	string
+		format	string
+		want	[]string
+	}{
+		{
+			"m3u8",
+			"\ufeff#EXTM3U\r\n#EXTINF:215,Artist - Title\r\na.mp3\r\n\r\n  sub/b.flac  \n# comment\nhttp://host/view/c.mp3?album=x\n",
+			PLAYLIST_FORMAT_M3U8,
+			[]string{"a.mp3", "sub/b.flac", "http://host/view/c.mp3?album=x"},
+		},
+		{
+			"plain list",
+			"a.mp3\nb.mp3",
+			PLAYLIST_FORMAT_M3U8,
+			[]string{"a.mp3", "b.mp3"},
+		},
+		{
+			"pls ordered by number",
+			"[playlist]\nFile2=b.mp3\nTitle2=B\nfile1 = a.mp3\nFile10=j.mp3\nFileX=x.mp3\nNumberOfEntries=3\nVersion=2\n",
+			PLAYLIST_FORMAT_PLS,
+			[]string{"b.mp3", "j.mp3"},
+		},
+		{
+			"pls case",
+			"[Playlist]\nFILE1=a.mp3\nFile3=c.mp3\nFile2=b.mp3\n",
+			PLAYLIST_FORMAT_PLS,
+			[]string{"a.mp3", "b.mp3", "c.mp3"},
+		},
+		{
+			"xspf",
+			`<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <trackList>
+    <track><location> file:///music/a.mp3 </location><title>A</title></track>
+    <track><location>b%20c.mp3</location></track>
+  </trackList>
+</playlist>`,
+			PLAYLIST_FORMAT_XSPF,
+			[]string{"file:///music/a.mp3", "b%20c.mp3"},
+		},
+		{
+			"xspf without namespace",
+			"<playlist version=\"1\"><trackList><track><location>a.mp3</location></track></trackList></playlist>",
+			PLAYLIST_FORMAT_XSPF,
+			[]string{"a.mp3"},
+		},
+		{
+			"empty",
+			"#EXTM3U\n",
+			PLAYLIST_FORMAT_M3U8,
+			[]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if format := detectPlaylistFormat([]byte(tt.data)); format != tt.format {
+				t.Fatalf("format %q, want %q", format, tt.format)
+			}
+			got, err := parsePlaylist(tt.format, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parsePlaylist(PLAYLIST_FORMAT_XSPF, []byte("<playlist><trackList>")); err == nil {
+		t.Error("want error of truncated xspf")
+	}
+	if _, err := parsePlaylist("wpl", []byte("a.mp3")); err == nil {
+		t.Error("want error of unknown format")
+	}
+
+}
+
+func TestFormatPlaylistRoundTrip(t *testing.T) {
+
+	tracks := []playlistTrack{
+		{"http://host/view/a.mp3?album=x", "Title", "Artist", 215.4},
+		{"http://host/view/b.mp3?album=x", "Two\r\nlines\nand\rmore", "", 0},
+		{"http://host/view/c%20d.mp3?album=x", "<&>", "Ünïcode", 1},
+	}
+	locations := []string{tracks[0].Location, tracks[1].Location, tracks[2].Location}
+
+	for _, format := range []string{PLAYLIST_FORMAT_M3U8, PLAYLIST_FORMAT_PLS, PLAYLIST_FORMAT_XSPF} {
+		t.Run(format, func(t *testing.T) {
+			data, err := formatPlaylist(format, "name", tracks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected := detectPlaylistFormat(data); detected != format {
+				t.Fatalf("detected %q", detected)
+			}
+			got, err := parsePlaylist(format, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, locations) {
+				t.Errorf("got %q, want %q", got, locations)
+			}
+		})
+	}
+
+	data, err := formatPlaylist(PLAYLIST_FORMAT_M3U8, "name", tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n" +
+		"#EXTINF:215,Artist - Title\n" + tracks[0].Location + "\n" +
+		"#EXTINF:-1,Two lines and more\n" + tracks[1].Location + "\n" +
+		"#EXTINF:1,Ünïcode - <&>\n" + tracks[2].Location + "\n"
+	if string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	if strings.Count(string(data), "\r") > 0 {
+		t.Error("carriage return in m3u8")
+	}
+
+}
+
+func TestExportPlaylistFile(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dir := addTestFile(t, "a", "x.mp3")
+	name := "Mix \"ü\"; 1"
+	must(gMetadataManager.CreatePlaylist(dir, name, []PlaylistEntry{{"a", "x.mp3"}}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/playlistFile?" + url.Values{
+		QUERY_ALBUM: {"a"}, QUERY_NAME: {name}, QUERY_FORMAT: {PLAYLIST_FORMAT_XSPF},
+	}.Encode(), nil)
+	w := httptest.NewRecorder()
+	apiPlaylistFile(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || params["filename"] != name + ".xspf" {
+		t.Errorf("Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if !strings.Contains(w.Body.String(), `<playlist xmlns="` + XSPF_NAMESPACE + `" version="1">`) {
+		t.Errorf("no namespace in\n%s", w.Body.String())
+	}
+
+}
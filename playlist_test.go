@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckPlaylistEntries(t *testing.T) {
+
+	newTestMetadataManager(t)
+	addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a", "p.jpg")
+	addTestFile(t, "b/c", "y.flac")
+
+	tests := []struct {
+		name	string
+		entries	[]PlaylistEntry
+		err		bool
+	}{
+		{"none", []PlaylistEntry{}, false},
+		{"albums", []PlaylistEntry{{"a", "x.mp3"}, {"b/c", "y.flac"}, {"a", "x.mp3"}}, false},
+		{"uncleaned album", []PlaylistEntry{{"/b//c/", "y.flac"}}, false},
+		{"not audio", []PlaylistEntry{{"a", "x.mp3"}, {"a", "p.jpg"}}, true},
+		{"missing file", []PlaylistEntry{{"a", "y.flac"}}, true},
+		{"missing album", []PlaylistEntry{{"d", "x.mp3"}}, true},
+		// Cleaned into uploads
+		{"parent album", []PlaylistEntry{{"../a", "x.mp3"}}, false},
+		{"invalid album", []PlaylistEntry{{"a" + META_SLASH_IN_FILENAME + "b", "x.mp3"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := gMetadataManager.checkPlaylistEntries(tt.entries)
+			if (err != nil) != tt.err {
+				t.Errorf("err %v, want error %v", err, tt.err)
+			}
+		})
+	}
+
+}
+
+func TestCrossAlbumPlaylist(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dirA := addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "b", "y.mp3")
+
+	entries := []PlaylistEntry{{"b", "y.mp3"}, {"a", "x.mp3"}}
+	must(gMetadataManager.CreatePlaylist(dirA, "mix", entries))
+	if err := gMetadataManager.CreatePlaylist(dirA, "mix", nil); err == nil {
+		t.Error("created the existing playlist again")
+	}
+	if err := gMetadataManager.CreatePlaylist(dirA, "bad", []PlaylistEntry{{"b", "z.mp3"}}); err == nil {
+		t.Error("created a playlist of a missing file")
+	}
+
+	reordered := []PlaylistEntry{{"a", "x.mp3"}, {"b", "y.mp3"}}
+	must(gMetadataManager.SetPlaylist(dirA, "mix", reordered))
+	pls, err := gMetadataManager.Playlists(dirA)
+	must(err)
+	if len(pls) != 2 || pls[0].Name != PLAYLIST_AUTO || pls[1].Name != "mix" || !slices.Equal(pls[1].Entries, reordered) {
+		t.Errorf("got %+v", pls)
+	}
+
+	// Auto playlist is of its album only
+	if err := gMetadataManager.SetPlaylist(dirA, PLAYLIST_AUTO, entries); err == nil {
+		t.Error("auto playlist references another album")
+	}
+	if err := gMetadataManager.SetPlaylist(dirA, PLAYLIST_AUTO, entries[1:]); err != nil {
+		t.Errorf("auto playlist err: %v", err)
+	}
+
+}
+
+func TestEditPlaylistHandler(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dir := addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a", "y.mp3")
+
+	post := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/editPlaylist?album=a", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		editPlaylistHandler(w, r)
+		return w.Code
+	}
+
+	if code := post(`["y.mp3","x.mp3"]`); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	pls, err := gMetadataManager.Playlists(dir)
+	must(err)
+	want := []PlaylistEntry{{"a", "y.mp3"}, {"a", "x.mp3"}}
+	if !slices.Equal(pls[0].Entries, want) {
+		t.Errorf("got %v, want %v", pls[0].Entries, want)
+	}
+
+	if code := post(`["z.mp3"]`); code != http.StatusBadRequest {
+		t.Errorf("missing file status %d", code)
+	}
+
+}
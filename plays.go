@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Play statistics
+//
+// POST /api/plays                  body {"album","base","device","seconds"} records a play event
+// GET  /api/plays?album=A          returns the statistics of the tracks in A by base
+// GET  /api/history                returns the play events, newest first,
+//                                  ?limit=N&before=T (unix milliseconds)&device=D&album=A filter them
+// GET  /api/smartPlaylist?kind=K   returns the entries of a generated playlist,
+//                                  ?album=A limits the tracks to A, ?days=N and ?limit=N
+//
+//   mostPlayed       most counted plays in the last N days, all time when 0
+//   recentlyPlayed   last played first in the last N days, all time when 0
+//   notPlayed        not played in the last N days, 30 by default, never played first
+//
+// A play is counted when it lasts PLAYS_COUNT_SECONDS or half of the track.
+// Events are kept by album and base, they follow the tracks moved through the APIs and renamed albums.
+// Events older than PLAYS_KEEP_DAYS are summed up per track into one compacted event at start
+// and every PLAYS_COMPACT_INTERVAL, so the history has the kept ones and N over it counts all time.
+
+const PLAYS_JSONL = "plays.jsonl"
+const PLAYS_COUNT_SECONDS = 30
+const PLAYS_DEFAULT_LIMIT = 100
+const PLAYS_NOT_PLAYED_DAYS = 30
+const PLAYS_KEEP_DAYS = 365
+const PLAYS_COMPACT_INTERVAL = time.Hour * 24
+
+const QUERY_LIMIT = "limit"
+const QUERY_BEFORE = "before"
+const QUERY_DEVICE = "device"
+const QUERY_KIND = "kind"
+const QUERY_DAYS = "days"
+
+const SMART_MOST_PLAYED = "mostPlayed"
+const SMART_RECENTLY_PLAYED = "recentlyPlayed"
+const SMART_NOT_PLAYED = "notPlayed"
+
+type PlayEvent struct {
+	Album		string		`json:"album"`
+	Base		string		`json:"base"`
+	Device		string		`json:"device"`
+	Time		time.Time	`json:"time"`
+	Seconds		float64		`json:"seconds"`
+	Counted		bool		`json:"counted"`
+	// Sums up the compacted events of the track, Count of which are counted
+	Compacted	bool		`json:"compacted,omitempty"`
+	Count		int			`json:"count,omitempty"`
+}
+
+type PlayStats struct {
+	Count		int			`json:"count"`
+	Seconds		float64		`json:"seconds"`
+	LastPlayed	time.Time	`json:"lastPlayed"`
+}
+
+type PlayHistory struct {
+	store		PlaysStore
+
+	events		[]*PlayEvent // of the last PLAYS_KEEP_DAYS, oldest first
+	old			map[PlaylistEntry] *PlayStats // of the compacted events
+	stats		map[PlaylistEntry] *PlayStats
+	compacted	time.Time
+	mu			sync.Mutex
+}
+
+var gPlayHistory *PlayHistory
+
+// PlaysStore persists the play events of PlayHistory
+type PlaysStore interface {
+	// AddPlay appends the play event
+	AddPlay(play *PlayEvent) error
+	// LoadPlays returns the play events in the order they were added
+	LoadPlays() ([]*PlayEvent, error)
+	// ReplacePlays stores the play events in place of all
+	ReplacePlays(plays []*PlayEvent) error
+}
+
+// NewPlaysStore returns the metadata store when it keeps plays too, plays.jsonl otherwise
+func NewPlaysStore(store MetadataStore) PlaysStore {
+
+	if plays, ok := store.(PlaysStore); ok {
+		return plays
+	}
+
+	return &jsonPlaysStore{}
+
+}
+
+// JSON plays store appends each event as a line of plays.jsonl
+type jsonPlaysStore struct {
+}
+
+// Not in metadata dir where *.json are dir caches
+func (store *jsonPlaysStore) playsPath() string {
+	return PLAYS_JSONL
+}
+
+func (store *jsonPlaysStore) AddPlay(play *PlayEvent) error {
+
+	data, err := json.Marshal(play)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioOpenFile(store.playsPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+
+}
+
+// ReplacePlays writes the next file which is renamed to plays.jsonl
+func (store *jsonPlaysStore) ReplacePlays(plays []*PlayEvent) error {
+
+	var buf bytes.Buffer
+	for _, play := range plays {
+		data, err := json.Marshal(play)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	partPath := store.playsPath() + ".part"
+	err := ioWriteFile(partPath, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(partPath, store.playsPath())
+
+}
+
+func (store *jsonPlaysStore) LoadPlays() ([]*PlayEvent, error) {
+
+	plays := make([]*PlayEvent, 0)
+
+	data, err := ioReadFile(store.playsPath())
+	if os.IsNotExist(err) {
+		return plays, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		play := &PlayEvent{}
+		if err := json.Unmarshal(line, play); err != nil {
+			// A line cut by a crash
+			logWarn("Malformed play event at line", i + 1, "of", store.playsPath(), "err:", err)
+			continue
+		}
+		plays = append(plays, play)
+	}
+
+	return plays, nil
+
+}
+
+func NewPlayHistory(store PlaysStore) *PlayHistory {
+
+	ph := &PlayHistory{}
+
+	ph.store	= store
+	ph.events	= make([]*PlayEvent, 0)
+	ph.old		= make(map[PlaylistEntry]*PlayStats)
+	ph.stats	= make(map[PlaylistEntry]*PlayStats)
+
+	return ph
+
+}
+
+func (ph *PlayHistory) Load() error {
+
+	plays, err := ph.store.LoadPlays()
+	if err != nil {
+		return err
+	}
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	for _, play := range plays {
+		ph.add(play)
+	}
+	logInfo("Loaded", len(plays), "play events")
+
+	return ph.compact()
+
+}
+
+// add must be called while holding ph.mu
+func (ph *PlayHistory) add(play *PlayEvent) {
+
+	if play.Compacted {
+		addPlayStats(ph.old, play)
+	} else {
+		ph.events = append(ph.events, play)
+	}
+	addPlayStats(ph.stats, play)
+
+}
+
+func addPlayStats(statsMap map[PlaylistEntry]*PlayStats, play *PlayEvent) {
+
+	key := PlaylistEntry{play.Album, play.Base}
+	stats, ok := statsMap[key]
+	if !ok {
+		stats = &PlayStats{}
+		statsMap[key] = stats
+	}
+	stats.Seconds += play.Seconds
+	if play.Compacted {
+		stats.Count += play.Count
+	} else if play.Counted {
+		stats.Count++
+	}
+	if play.Time.After(stats.LastPlayed) {
+		stats.LastPlayed = play.Time
+	}
+
+}
+
+// compact must be called while holding ph.mu, it sums up the events older than
+// PLAYS_KEEP_DAYS into the compacted ones and replaces the stored events if there are
+func (ph *PlayHistory) compact() error {
+
+	ph.compacted = time.Now()
+
+	cutoff := time.Now().AddDate(0, 0, -PLAYS_KEEP_DAYS)
+	n := 0
+	for n < len(ph.events) && ph.events[n].Time.Before(cutoff) {
+		addPlayStats(ph.old, ph.events[n])
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	ph.events = slices.Clone(ph.events[n:])
+
+	err := ph.store.ReplacePlays(ph.plays())
+	if err != nil {
+		return err
+	}
+	logInfo("Compacted", n, "play events older than", PLAYS_KEEP_DAYS, "days")
+
+	return nil
+
+}
+
+// plays must be called while holding ph.mu, it returns the events to store, compacted ones first
+func (ph *PlayHistory) plays() []*PlayEvent {
+
+	plays := make([]*PlayEvent, 0, len(ph.old) + len(ph.events))
+	for key, stats := range ph.old {
+		plays = append(plays, &PlayEvent{
+			Album:		key.Album,
+			Base:		key.Base,
+			Time:		stats.LastPlayed,
+			Seconds:	stats.Seconds,
+			Compacted:	true,
+			Count:		stats.Count,
+		})
+	}
+	sort.Slice(plays, func(i, j int) bool {
+		return plays[i].Time.Before(plays[j].Time)
+	})
+
+	return append(plays, ph.events...)
+
+}
+
+// rekey moves the events and statistics of the tracks for which move returns true
+// to the returned album and base, then replaces the stored events
+func (ph *PlayHistory) rekey(move func(key PlaylistEntry) (PlaylistEntry, bool)) {
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	changed := false
+	for _, play := range ph.events {
+		if key, ok := move(PlaylistEntry{play.Album, play.Base}); ok {
+			play.Album, play.Base = key.Album, key.Base
+			changed = true
+		}
+	}
+	for _, statsMap := range []map[PlaylistEntry]*PlayStats{ph.old, ph.stats} {
+		for key, stats := range maps.Clone(statsMap) {
+			newKey, ok := move(key)
+			if !ok {
+				continue
+			}
+			changed = true
+			delete(statsMap, key)
+			// Merged into those of a track removed before
+			if stats1, ok := statsMap[newKey]; ok {
+				stats.Count += stats1.Count
+				stats.Seconds += stats1.Seconds
+				if stats1.LastPlayed.After(stats.LastPlayed) {
+					stats.LastPlayed = stats1.LastPlayed
+				}
+			}
+			statsMap[newKey] = stats
+		}
+	}
+	if !changed {
+		return
+	}
+
+	err := ph.store.ReplacePlays(ph.plays())
+	if err != nil {
+		logWarn("Failed to store moved play events err:", err)
+	}
+
+}
+
+// Move carries the events and statistics of the track over to its new album and base
+func (ph *PlayHistory) Move(album, base, newAlbum, newBase string) {
+
+	ph.rekey(func(key PlaylistEntry) (PlaylistEntry, bool) {
+		return PlaylistEntry{newAlbum, newBase}, key.Album == album && key.Base == base
+	})
+
+}
+
+// MoveAlbum carries those of the album and its sub albums over to the new album
+func (ph *PlayHistory) MoveAlbum(album, newAlbum string) {
+
+	ph.rekey(func(key PlaylistEntry) (PlaylistEntry, bool) {
+		if key.Album != album && !strings.HasPrefix(key.Album, album + "/") {
+			return key, false
+		}
+		return PlaylistEntry{newAlbum + key.Album[len(album):], key.Base}, true
+	})
+
+}
+
+func (ph *PlayHistory) Record(play PlayEvent) error {
+
+	dir, err := getAlbumDir(play.Album)
+	if err != nil {
+		return err
+	}
+	meta, ok := gMetadataManager.GetMetadata(dir, play.Base)
+	if !ok {
+		return fmt.Errorf("File not found %s", play.Base)
+	}
+	if !isAudio(meta.MimeType) {
+		return fmt.Errorf("Not an audio file %s", play.Base)
+	}
+	if math.IsNaN(play.Seconds) || math.IsInf(play.Seconds, 0) || play.Seconds < 0 {
+		return fmt.Errorf("Invalid seconds %v", play.Seconds)
+	}
+
+	play.Album = filepath.ToSlash(cleanAlbumPath(play.Album))
+	play.Time = time.Now().UTC()
+	play.Counted = play.Seconds >= PLAYS_COUNT_SECONDS ||
+		(meta.Media != nil && meta.Media.Duration > 0 && play.Seconds >= meta.Media.Duration / 2)
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	err = ph.store.AddPlay(&play)
+	if err != nil {
+		return err
+	}
+	ph.add(&play)
+
+	if time.Since(ph.compacted) >= PLAYS_COMPACT_INTERVAL {
+		if err := ph.compact(); err != nil {
+			logWarn("Failed to compact play events err:", err)
+		}
+	}
+
+	return nil
+
+}
+
+// Stats returns the statistics of the album by base
+func (ph *PlayHistory) Stats(album string) map[string]PlayStats {
+
+	album = filepath.ToSlash(cleanAlbumPath(album))
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	result := make(map[string]PlayStats)
+	for key, stats := range ph.stats {
+		if key.Album == album {
+			result[key.Base] = *stats
+		}
+	}
+
+	return result
+
+}
+
+// History returns the events before the time, newest first, filtered by device and album when not empty
+func (ph *PlayHistory) History(before time.Time, device, album string, limit int) []PlayEvent {
+
+	if album != "" {
+		album = filepath.ToSlash(cleanAlbumPath(album))
+	}
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	result := make([]PlayEvent, 0)
+	for i := len(ph.events) - 1; i >= 0 && len(result) < limit; i-- {
+		play := ph.events[i]
+		if (!before.IsZero() && !play.Time.Before(before)) ||
+			(device != "" && play.Device != device) ||
+			(album != "" && play.Album != album) {
+			continue
+		}
+		result = append(result, *play)
+	}
+
+	return result
+
+}
+
+// audioEntries returns the audio files of the album, or of all albums when all is true
+func (mgr *MetadataManager) audioEntries(album string, all bool) []PlaylistEntry {
+
+	mgr.cacheMapMu.RLock()
+	caches := make([]*metadataCache, 0, len(mgr.cacheMap))
+	for dir, cache := range mgr.cacheMap {
+		if all || dir == filepath.Join(gAppInfo.UploadDir, cleanAlbumPath(album)) {
+			caches = append(caches, cache)
+		}
+	}
+	mgr.cacheMapMu.RUnlock()
+
+	entries := make([]PlaylistEntry, 0)
+	for _, cache := range caches {
+		album := getAlbumOfDir(cache.dir)
+		cache.bodyMu.Lock()
+		for base, meta := range cache.body.MetaMap {
+			if isAudio(meta.MimeType) {
+				entries = append(entries, PlaylistEntry{album, base})
+			}
+		}
+		cache.bodyMu.Unlock()
+	}
+
+	return entries
+
+}
+
+// SmartPlaylist returns the entries of the kind among the audio files
+func (ph *PlayHistory) SmartPlaylist(kind string, files []PlaylistEntry, days, limit int) ([]PlaylistEntry, error) {
+
+	since := time.Time{}
+	if days > 0 {
+		since = time.Now().AddDate(0, 0, -days)
+	}
+
+	// Counted plays since
+	counts := make(map[PlaylistEntry]int)
+	lastPlayed := make(map[PlaylistEntry]time.Time)
+	ph.mu.Lock()
+	if days == 0 || days > PLAYS_KEEP_DAYS {
+		// Compacted events are in the statistics only
+		for key, stats := range ph.stats {
+			if stats.Count > 0 {
+				counts[key] = stats.Count
+				lastPlayed[key] = stats.LastPlayed
+			}
+		}
+	} else {
+		for _, play := range ph.events {
+			if !play.Counted || play.Time.Before(since) {
+				continue
+			}
+			key := PlaylistEntry{play.Album, play.Base}
+			counts[key]++
+			if play.Time.After(lastPlayed[key]) {
+				lastPlayed[key] = play.Time
+			}
+		}
+	}
+	ph.mu.Unlock()
+
+	entries := make([]PlaylistEntry, 0)
+	switch kind {
+	case SMART_MOST_PLAYED, SMART_RECENTLY_PLAYED:
+		for _, entry := range files {
+			if counts[entry] > 0 {
+				entries = append(entries, entry)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i], entries[j]
+			if kind == SMART_MOST_PLAYED && counts[a] != counts[b] {
+				return counts[a] > counts[b]
+			}
+			return lastPlayed[a].After(lastPlayed[b])
+		})
+	case SMART_NOT_PLAYED:
+		// Older plays come first
+		allLastPlayed := make(map[PlaylistEntry]time.Time)
+		ph.mu.Lock()
+		for _, entry := range files {
+			if counts[entry] > 0 {
+				continue
+			}
+			entries = append(entries, entry)
+			if stats, ok := ph.stats[entry]; ok && stats.Count > 0 {
+				allLastPlayed[entry] = stats.LastPlayed
+			}
+		}
+		ph.mu.Unlock()
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i], entries[j]
+			if !allLastPlayed[a].Equal(allLastPlayed[b]) {
+				return allLastPlayed[a].Before(allLastPlayed[b])
+			}
+			if a.Album != b.Album {
+				return a.Album < b.Album
+			}
+			return a.Base < b.Base
+		})
+	default:
+		return nil, fmt.Errorf("Unknown smart playlist %q", kind)
+	}
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+
+}
+
+func parseQueryInt(r *http.Request, key string, fallback int) (int, error) {
+
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s %q", key, value)
+	}
+
+	return n, nil
+
+}
+
+func apiPlays(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+
+		serveJson(w, r, gPlayHistory.Stats(r.URL.Query().Get(QUERY_ALBUM)))
+
+	case http.MethodPost:
+
+		// sendBeacon posts text/plain
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to read body", err)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		var play PlayEvent
+		if err := json.Unmarshal(data, &play); err != nil {
+			logHTTPRequest(r, -1, "Failed to parse json", err)
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		err = gPlayHistory.Record(play)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to record play err:", err)
+			http.Error(w, "Failed to record play", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		logHTTPRequest(r, -1, "Invalid method for plays")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+
+}
+
+func apiHistory(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	limit, err := parseQueryInt(r, QUERY_LIMIT, PLAYS_DEFAULT_LIMIT)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before := time.Time{}
+	if query.Has(QUERY_BEFORE) {
+		ms, err := strconv.ParseInt(query.Get(QUERY_BEFORE), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = time.UnixMilli(ms)
+	}
+
+	serveJson(w, r, gPlayHistory.History(before, query.Get(QUERY_DEVICE), query.Get(QUERY_ALBUM), limit))
+
+}
+
+func apiSmartPlaylist(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	kind := query.Get(QUERY_KIND)
+
+	defaultDays := 0
+	if kind == SMART_NOT_PLAYED {
+		defaultDays = PLAYS_NOT_PLAYED_DAYS
+	}
+	days, err := parseQueryInt(r, QUERY_DAYS, defaultDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseQueryInt(r, QUERY_LIMIT, PLAYS_DEFAULT_LIMIT)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files := gMetadataManager.audioEntries(query.Get(QUERY_ALBUM), !query.Has(QUERY_ALBUM))
+	entries, err := gPlayHistory.SmartPlaylist(kind, files, days, limit)
+	if err != nil {
+		logHTTPRequest(r, -1, "Failed to make smart playlist err:", err)
+		http.Error(w, "Unknown kind", http.StatusBadRequest)
+		return
+	}
+
+	serveJson(w, r, entries)
+
+}
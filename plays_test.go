@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlayHistoryCompact(t *testing.T) {
+
+	newTestMetadataManager(t)
+	store := &jsonPlaysStore{}
+
+	old := time.Now().UTC().AddDate(0, 0, -PLAYS_KEEP_DAYS - 10)
+	recent := time.Now().UTC().AddDate(0, 0, -1)
+	plays := []*PlayEvent{
+		{Album: "a", Base: "x.mp3", Time: old, Seconds: 100, Counted: true},
+		{Album: "a", Base: "x.mp3", Time: old.Add(time.Hour), Seconds: 5},
+		{Album: "b", Base: "y.mp3", Time: old, Seconds: 40, Counted: true},
+		{Album: "a", Base: "x.mp3", Time: recent, Seconds: 60, Counted: true},
+	}
+	for _, play := range plays {
+		must(store.AddPlay(play))
+	}
+
+	load := func() *PlayHistory {
+		ph := NewPlayHistory(store)
+		must(ph.Load())
+		return ph
+	}
+	check := func(ph *PlayHistory) {
+		t.Helper()
+		stats := ph.Stats("a")["x.mp3"]
+		if stats.Count != 2 || stats.Seconds != 165 || !stats.LastPlayed.Equal(recent) {
+			t.Errorf("stats %+v", stats)
+		}
+		if history := ph.History(time.Time{}, "", "", 10); len(history) != 1 || !history[0].Time.Equal(recent) {
+			t.Errorf("history %+v", history)
+		}
+		entries, err := ph.SmartPlaylist(SMART_MOST_PLAYED, []PlaylistEntry{{"a", "x.mp3"}, {"b", "y.mp3"}}, 0, 10)
+		must(err)
+		if want := []PlaylistEntry{{"a", "x.mp3"}, {"b", "y.mp3"}}; !slices.Equal(entries, want) {
+			t.Errorf("all time most played %v, want %v", entries, want)
+		}
+		entries, err = ph.SmartPlaylist(SMART_MOST_PLAYED, []PlaylistEntry{{"a", "x.mp3"}, {"b", "y.mp3"}}, 30, 10)
+		must(err)
+		if want := []PlaylistEntry{{"a", "x.mp3"}}; !slices.Equal(entries, want) {
+			t.Errorf("recent most played %v, want %v", entries, want)
+		}
+	}
+
+	check(load())
+	stored, err := store.LoadPlays()
+	must(err)
+	if len(stored) != 3 || !stored[0].Compacted || !stored[1].Compacted || stored[2].Compacted {
+		t.Fatalf("stored %+v", stored)
+	}
+
+	// Compacted ones are loaded as they are
+	data, err := os.ReadFile(PLAYS_JSONL)
+	must(err)
+	check(load())
+	data1, err := os.ReadFile(PLAYS_JSONL)
+	must(err)
+	if !bytes.Equal(data, data1) {
+		t.Errorf("compacted again\n%s\n%s", data, data1)
+	}
+
+}
+
+func TestPlayHistoryMove(t *testing.T) {
+
+	newTestMetadataManager(t)
+	dirA := addTestFile(t, "a", "x.mp3")
+	addTestFile(t, "a/sub", "z.mp3")
+	dirB := addTestFile(t, "b", "y.mp3")
+
+	recent := time.Now().UTC().AddDate(0, 0, -1)
+	for _, play := range []*PlayEvent{
+		{Album: "a", Base: "x.mp3", Time: recent, Seconds: 60, Counted: true},
+		{Album: "a/sub", Base: "z.mp3", Time: recent, Seconds: 60, Counted: true},
+		{Album: "b", Base: "x.mp3", Time: recent.AddDate(0, 0, -PLAYS_KEEP_DAYS), Seconds: 50, Counted: true},
+	} {
+		must(gPlayHistory.store.AddPlay(play))
+	}
+	must(gPlayHistory.Load())
+
+	// Onto the stats of a track removed before
+	newBase, err := gMetadataManager.MoveFile(dirA, "x.mp3", dirB, "x.mp3", false)
+	must(err)
+	if newBase != "x.mp3" {
+		t.Fatalf("moved to %s", newBase)
+	}
+	must(gMetadataManager.RenameDir(dirA, dirA + "2"))
+
+	for _, ph := range []*PlayHistory{gPlayHistory, NewPlayHistory(gPlayHistory.store)} {
+		if ph != gPlayHistory {
+			must(ph.Load())
+		}
+		if stats := ph.Stats("b")["x.mp3"]; stats.Count != 2 || stats.Seconds != 110 {
+			t.Errorf("moved stats %+v", stats)
+		}
+		if stats := ph.Stats("a2/sub")["z.mp3"]; stats.Count != 1 {
+			t.Errorf("renamed album stats %+v", stats)
+		}
+		if stats := ph.Stats("a/sub"); len(stats) != 0 {
+			t.Errorf("stats left in the old album %+v", stats)
+		}
+		if history := ph.History(time.Time{}, "", "a2/sub", 10); len(history) != 1 {
+			t.Errorf("history of the renamed album %+v", history)
+		}
+	}
+
+}
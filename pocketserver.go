@@ -21,6 +21,7 @@ import (
 	"context"
 	"time"
 	"strings"
+	"strconv"
 )
 
 import "embed"
@@ -49,13 +50,19 @@ const MIME_AUDIO = "audio"
 const MIME_VIDEO = "video"
 
 const META_EXT_TXT = ".json"
-const META_EXT_THUMB = ".jpg"
+const META_EXT_THUMB = ".webp"
 const META_EXT_THUMB_SMALL = "_small.webp"
+const META_EXT_SPRITE = "_sprite.webp"
+const META_EXT_SPRITE_VTT = "_sprite.vtt"
+const META_EXT_DISPLAY = "_display.jpg"
+const META_EXT_WAVEFORM = "_waveform.json"
 const META_SLASH_IN_FILENAME = "###"
-const FFMPEG_CMD_BASE = "ffmpeg -y -i '%s' "
-const FFMPEG_CMD_AUDIO_THUMB = "-an -c:v copy '%s'"
-const FFMPEG_CMD_AUDIO_THUMB_SMALL = "-vf 'scale=iw*sqrt(16384/(iw*ih)):-1' -an -c:v libwebp -q:v 80 '%s'"
-const FFMPEG_CMD_VIDEO_THUMB = "-ss 00:00:01 -vframes 1 '%s'"
+
+// Metadata files made for a file are named base + one of these
+var gMetaExts = []string{
+	META_EXT_TXT, META_EXT_THUMB, META_EXT_THUMB_SMALL,
+	META_EXT_SPRITE, META_EXT_DISPLAY, META_EXT_WAVEFORM,
+}
 const FFMPEG_WS_SOCKET_CLOSED = "POCKETSERVER_FFMPEG_WEBSOCKET_CLOSED"
 const FFMPEG_WS_SERVER_FAILED = "POCKETSERVER_FFMPEG_WEBSOCKET_SERVER_FAILED"
 
@@ -85,8 +92,12 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handling uploads
-	album := filepath.Base(r.URL.Query().Get(QUERY_ALBUM))
-	uploadDir := filepath.Join(gAppInfo.UploadDir, album)
+	uploadDir, err := getAlbumDir(r.URL.Query().Get(QUERY_ALBUM))
+	if err != nil {
+		logHTTPRequest(r, -1, "getAlbumDir err:", err)
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
 	metaDir := filepath.Join(gAppInfo.MetadataDir, uploadDir)
 	fullpathFile := ""
 	fullpathProgress := ""
@@ -245,6 +256,37 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check duplicate
+	progressInfo, err := ioStat(fullpathProgress)
+	if err != nil {
+		logHTTPRequest(r, -1, fullpathProgress, "ioStat err:", err)
+		http.Error(w, "Error doing stat of uploaded file", http.StatusInternalServerError)
+		return
+	}
+	action, loc := findDuplicateAction(
+		r.URL.Query().Get(QUERY_DUPLICATE), uploadDir, progressInfo.Size(), crc32_0)
+	if action != "" {
+
+		ioRemove(fullpathProgress)
+		for key := range keyMap {
+			if strings.HasPrefix(key, "metadata:") {
+				ioRemove(filepath.Join(metaDir, base) + key[9:])
+			}
+		}
+
+		result, err := applyDuplicateAction(action, uploadDir, base, loc)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to handle duplicate err:", err)
+			http.Error(w, "Failed to handle duplicate", http.StatusInternalServerError)
+			return
+		}
+
+		logHTTPRequest(r, -1, "UPLOAD DUPLICATE", action, base, loc.Album, loc.Base)
+		serveJson(w, r, result)
+		return
+
+	}
+
 	err = os.Rename(fullpathProgress, fullpathFile)
 	if err != nil {
 		logHTTPRequest(r, -1, fullpathProgress, "os.Rename err:", err)
@@ -273,13 +315,17 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 
 
+// Deprecated: PUT /api/playlists with name=auto replaces it, kept for pages loaded before
 func editPlaylistHandler(w http.ResponseWriter, r *http.Request) {
 	
 	//
-	dir := filepath.Join(
-		gAppInfo.UploadDir,
-		filepath.Base(r.URL.Query().Get(QUERY_ALBUM)),
-	)
+	album := r.URL.Query().Get(QUERY_ALBUM)
+	dir, err := getAlbumDir(album)
+	if err != nil {
+		logHTTPRequest(r, -1, "getAlbumDir err:", err)
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
 
 	if r.Method != http.MethodPost {
 		logHTTPRequest(r, -1, "Invalid method")
@@ -303,7 +349,11 @@ func editPlaylistHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = gMetadataManager.EditPlaylist(dir, pl1)
+	entries := make([]PlaylistEntry, 0, len(pl1))
+	for _, base := range pl1 {
+		entries = append(entries, PlaylistEntry{album, base})
+	}
+	err = gMetadataManager.SetPlaylist(dir, PLAYLIST_AUTO, entries)
 	if err != nil {
 		logHTTPRequest(r, -1, "Failed to edit playlist", err)
 		http.Error(w, "Failed to edit playlist", http.StatusBadRequest)
@@ -317,15 +367,18 @@ func editPlaylistHandler(w http.ResponseWriter, r *http.Request) {
 func listHandler(w http.ResponseWriter, r *http.Request) {
 
 	//
-	dir := filepath.Join(
-		gAppInfo.UploadDir,
-		filepath.Base(r.URL.Query().Get(QUERY_ALBUM)),
-	)
+	dir, err := getAlbumDir(r.URL.Query().Get(QUERY_ALBUM))
+	if err != nil {
+		logHTTPRequest(r, -1, "getAlbumDir err:", err)
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
 
 	//
 	cached := r.URL.Query().Has(QUERY_CACHE)
 
-	if cached == false {
+	// Watched dirs are kept up to date by events
+	if cached == false && gMetadataManager.Watched(dir) == false {
 			
 		// Update
 		err := gMetadataManager.UpdateDir(dir)
@@ -338,21 +391,36 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get cache
-	data, ok := gMetadataManager.Get(dir)
+	data, version, ok := gMetadataManager.Get(dir)
 	if !ok {
 		logHTTPRequest(r, -1, "Invalid directory: ", dir)
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
-	/*if checkNotModified(r, mod) {
+	etag := formatVersionEtag(version)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r, etag) {
 		w.WriteHeader(http.StatusNotModified)
 		return
-	}*/
+	}
+
+	// Delta, whole body when unknown
+	if query := r.URL.Query(); query.Has(QUERY_SINCE) {
+		since, err := strconv.ParseUint(query.Get(QUERY_SINCE), 10, 64)
+		if err != nil {
+			logHTTPRequest(r, -1, "Invalid since:", query.Get(QUERY_SINCE))
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		if delta, ok := gMetadataManager.Delta(dir, since); ok {
+			data = delta
+		}
+	}
 
-	w.Header().Set("Cache-Control", "public, no-store")
-	w.Header().Set("Content-Type", "application/json")
-	//w.Header().Set("Last-Modified", mod.UTC().Format(http.TimeFormat)) // TODO put if modified in fetch
 	fmt.Fprint(w, string(data))
 
 }
@@ -385,12 +453,22 @@ func viewHandler(w http.ResponseWriter, r *http.Request) {
 	// Specify the path to your file
 	base		:= filepath.Base(r.URL.Path)
 	query		:= r.URL.Query()
-	album		:= query.Get(QUERY_ALBUM)
-	dir			:= filepath.Join(gAppInfo.UploadDir, filepath.Base(album))
-	fullpath	:= filepath.Join(dir, base)
+	fullpath	:= getUploadFullpath(query.Get(QUERY_ALBUM), base)
 	metaSuffix	:= query.Get(QUERY_METADATA)
 
-	if metaSuffix != "" {
+	if query.Has(QUERY_TRANSCODE) {
+
+		serveTranscode(w, r, query.Get(QUERY_ALBUM), base)
+
+	} else if query.Has(QUERY_WIDTH) || query.Has(QUERY_HEIGHT) || query.Has(QUERY_IMAGE_FORMAT) {
+
+		serveResize(w, r, query.Get(QUERY_ALBUM), base)
+
+	} else if metaSuffix == META_EXT_SPRITE_VTT {
+
+		serveSpriteVTT(w, r, query.Get(QUERY_ALBUM), base)
+
+	} else if metaSuffix != "" {
 
 		metaFullpath := filepath.Join(gAppInfo.MetadataDir, fullpath) + metaSuffix
 
@@ -501,6 +579,13 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Ensure responseWriter implements http.Flusher for streaming responses
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Ensure responseWriter implements http.Hijacker if the underlying ResponseWriter supports it
 func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	// Check if the underlying ResponseWriter supports the http.Hijacker interface
@@ -511,6 +596,12 @@ func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hijacker.Hijack()
 }
 
+// Long-lived connections not counted in PerformanceConfig.MaxConcurrentRequests
+var gStreamingPaths = map[string]bool{
+	"/api/events":	true,
+	"/ws/party":	true,
+}
+
 func performanceMiddlewareFactory(config PerformanceConfig) func(http.Handler) http.Handler {
 
 	performance := struct{
@@ -630,14 +721,16 @@ func performanceMiddlewareFactory(config PerformanceConfig) func(http.Handler) h
 				mu.Unlock()
 			}()
 
-			// Semaphore for limited environment
-			ok := sem.Acquire()
-			if !ok {
-				logHTTPRequest(r, -1, "TIMEOUT")
-				http.Error(w, "Timeout", http.StatusServiceUnavailable)
-				return
+			// Semaphore for limited environment, streams would hold slots for their lifetime
+			if !gStreamingPaths[r.URL.Path] {
+				ok := sem.Acquire()
+				if !ok {
+					logHTTPRequest(r, -1, "TIMEOUT")
+					http.Error(w, "Timeout", http.StatusServiceUnavailable)
+					return
+				}
+				defer sem.Release()
 			}
-			defer sem.Release()
 
 			checkMemstats()
 			
@@ -757,23 +850,41 @@ func main() {
 	}
 
 	// Start metadata manager
-	gMetadataManager = NewMetadataManager()
+	store, err := NewMetadataStore(gAppInfo.MetadataStore)
+	must(err)
+	logInfo("Metadata store is", gAppInfo.MetadataStore)
+	gMetadataManager = NewMetadataManager(store)
+	if err := gMetadataManager.Watch(); err != nil {
+		logWarn(err)
+	}
 	must(gMetadataManager.LoadDirCaches())
+	gPlayHistory = NewPlayHistory(NewPlaysStore(store))
+	must(gPlayHistory.Load())
+	gPlayback = NewPlaybackManager()
+	must(gPlayback.Load())
 	go func() {
-		dentries, err := ioReadDir(gAppInfo.UploadDir)
-		must(err)
-		dirs := []string{}
-		dirs = append(dirs, gAppInfo.UploadDir)
-		for _, dentry := range dentries {
-			if dentry.IsDir() {
-				dirs = append(dirs, filepath.Join(gAppInfo.UploadDir, dentry.Name()))
-			}
-		}
-		for _, dir := range dirs {
-			gMetadataManager.AddDir(dir)
-			if err = gMetadataManager.UpdateDir(dir); err != nil {
+		// Updating a dir registers its sub dirs
+		dirs := []string{gAppInfo.UploadDir}
+		gMetadataManager.AddDir(gAppInfo.UploadDir)
+		for len(dirs) > 0 {
+			dir := dirs[0]
+			dirs = dirs[1:]
+			if err := gMetadataManager.UpdateDir(dir); err != nil {
 				logFatal(fmt.Errorf("Failed to cache dir %s: %w", dir, err))
 			}
+			dirs = append(dirs, gMetadataManager.Children(dir)...)
+		}
+	}()
+
+	// Resumable uploads
+	gUploadSessions = NewUploadSessionManager()
+	must(gUploadSessions.Load())
+
+	// Derived caches
+	go func() {
+		for {
+			pruneCaches(PERF_CACHE_MAX_SIZE)
+			time.Sleep(CACHE_PRUNE_INTERVAL)
 		}
 	}()
 
@@ -786,9 +897,11 @@ func main() {
 	mux.HandleFunc("/static/", staticHandler)
 	mux.HandleFunc("/ping", pingHandler)
 	mux.HandleFunc("/view/", viewHandler)
+	mux.HandleFunc(URL_HLS, hlsHandler)
 	mux.HandleFunc("/upload", uploadHandler)
+	mux.HandleFunc("/upload/session", uploadSessionHandler)
 	mux.HandleFunc("/list", listHandler)
-	mux.HandleFunc("/editPlaylist", editPlaylistHandler)
+	mux.HandleFunc("/editPlaylist", editPlaylistHandler) // deprecated
 	mux.HandleFunc("/signout", signoutHandler)
 	mux.Handle("/api/", apiMux)
 
@@ -796,6 +909,7 @@ func main() {
 	// init ffmpeg http handler and the relevant unix socket
 	initFFmpegSocket()
 	mux.HandleFunc("/ws/ffmpeg", ffmpegHandler)
+	mux.HandleFunc("/ws/party", partyHandler)
 
 	//
 	performanceMiddleware := performanceMiddlewareFactory(gPerformanceConfig)
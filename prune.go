@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Derived caches
+//
+// MetadataDir/{hls,transcode,resize} hold outputs named by the content key of the source which are
+// made again when missing. Every CACHE_PRUNE_INTERVAL the least recently used entries are
+// removed until the total is under PERF_CACHE_MAX_SIZE, those used within CACHE_PRUNE_IDLE are kept.
+
+const CACHE_PRUNE_INTERVAL = time.Minute * 30
+const CACHE_PRUNE_IDLE = time.Hour
+
+var gCacheDirs = []string{HLS_DIR, TRANSCODE_DIR, RESIZE_DIR}
+
+var gCacheUses = make(map[string]time.Time) // by entry path, since start
+var gCacheUsesMu sync.Mutex
+
+// touchCache marks the entry as used, call it before checking the entry exists
+func touchCache(path string) {
+
+	gCacheUsesMu.Lock()
+	defer gCacheUsesMu.Unlock()
+
+	gCacheUses[path] = time.Now()
+
+}
+
+type cacheEntry struct {
+	path	string
+	size	int64
+	used	time.Time
+}
+
+// statCacheEntry returns the total size and the latest modification of the file or dir
+func statCacheEntry(path string) (int64, time.Time, error) {
+
+	var size int64
+	var modTime time.Time
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+
+	return size, modTime, err
+
+}
+
+func pruneCaches(maxSize int64) {
+
+	var entries []cacheEntry
+	var total int64
+	for _, name := range gCacheDirs {
+		dir := filepath.Join(gAppInfo.MetadataDir, name)
+		items, err := ioReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, item := range items {
+			// Being written
+			if strings.HasSuffix(item.Name(), ".part") {
+				continue
+			}
+			path := filepath.Join(dir, item.Name())
+			size, modTime, err := statCacheEntry(path)
+			if err != nil {
+				continue
+			}
+			total += size
+			entries = append(entries, cacheEntry{path, size, modTime})
+		}
+	}
+	if total <= maxSize {
+		return
+	}
+
+	gCacheUsesMu.Lock()
+	defer gCacheUsesMu.Unlock()
+
+	for i := range entries {
+		if used, ok := gCacheUses[entries[i].path]; ok && used.After(entries[i].used) {
+			entries[i].used = used
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+
+	// Removed while holding the lock so that an entry touched before is not
+	removed := 0
+	for _, entry := range entries {
+		if total <= maxSize || time.Since(entry.used) < CACHE_PRUNE_IDLE {
+			break
+		}
+		if err := os.RemoveAll(entry.path); err != nil {
+			logWarn("Failed to prune", entry.path, "err:", err)
+			continue
+		}
+		delete(gCacheUses, entry.path)
+		total -= entry.size
+		removed++
+	}
+	if removed > 0 {
+		logInfo("Pruned", removed, "cache entries, total", total, "bytes")
+	}
+
+}
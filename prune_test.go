@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPruneCaches(t *testing.T) {
+
+	gAppInfo.MetadataDir = t.TempDir()
+	old := time.Now().Add(-CACHE_PRUNE_IDLE * 3)
+	write := func(name string, modTime time.Time) {
+		path := filepath.Join(gAppInfo.MetadataDir, name)
+		must(os.MkdirAll(filepath.Dir(path), 0755))
+		must(os.WriteFile(path, make([]byte, 100), 0644))
+		must(os.Chtimes(path, modTime, modTime))
+	}
+	write("resize/A_640x0.jpg", old)
+	write("resize/B_640x0.jpg", old.Add(time.Minute))
+	write("resize/C_640x0.jpg.part", old)
+	write("hls/D/seg_00000.m4s", old.Add(-time.Minute))
+	must(os.Chtimes(filepath.Join(gAppInfo.MetadataDir, "hls/D"), old, old))
+	write("transcode/E_192k.aac", time.Now())
+	write("transcode/F_192k.aac", old.Add(time.Hour))
+
+	// Used since start, otherwise the oldest
+	touchCache(filepath.Join(gAppInfo.MetadataDir, "hls/D"))
+	pruneCaches(300)
+
+	tests := []struct {
+		name	string
+		kept	bool
+	}{
+		{"resize/A_640x0.jpg", false},
+		{"resize/B_640x0.jpg", false},
+		{"resize/C_640x0.jpg.part", true},
+		{"hls/D", true},
+		{"transcode/E_192k.aac", true},
+		{"transcode/F_192k.aac", true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(gAppInfo.MetadataDir, tt.name))
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s kept %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+
+	// Recently used ones are kept over the size
+	pruneCaches(0)
+	for _, name := range []string{"hls/D", "transcode/E_192k.aac"} {
+		if _, err := os.Stat(filepath.Join(gAppInfo.MetadataDir, name)); err != nil {
+			t.Errorf("%s is removed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(gAppInfo.MetadataDir, "transcode/F_192k.aac")); err == nil {
+		t.Error("transcode/F_192k.aac is kept")
+	}
+
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Remote control
+//
+// GET  /api/events?device=D&name=N   the player D receives commands as "command" events
+// GET  /api/devices                  returns the connected players
+// PUT  /api/devices?device=D         body is the status of the player, reported by D
+// POST /api/devices?device=D         body is a command for D
+//
+//   {"command": "play"}                               resumes, or plays base of album when given
+//   {"command": "pause"}
+//   {"command": "next"}, {"command": "prev"}
+//   {"command": "seek", "position": seconds}
+//   {"command": "enqueue", "album": A, "base": B}     plays B after the current track
+//
+// D identifies a page rather than a browser so that tabs are separate players,
+// a device connecting again replaces its previous connection.
+
+const REMOTE_SEND_BUFFER = 16
+const REMOTE_NAME_LIMIT = 64
+const EVENT_COMMAND = "command"
+
+const REMOTE_PLAY = "play"
+const REMOTE_PAUSE = "pause"
+const REMOTE_NEXT = "next"
+const REMOTE_PREV = "prev"
+const REMOTE_SEEK = "seek"
+const REMOTE_ENQUEUE = "enqueue"
+
+type RemoteCommand struct {
+	ID			uint64		`json:"id"`
+	Command		string		`json:"command"`
+	Album		string		`json:"album,omitempty"`
+	Base		string		`json:"base,omitempty"`
+	Position	float64		`json:"position,omitempty"`
+}
+
+type RemoteStatus struct {
+	Album		string		`json:"album"`
+	Base		string		`json:"base"`
+	Position	float64		`json:"position"`
+	Playing		bool		`json:"playing"`
+}
+
+type RemoteDevice struct {
+	Device		string			`json:"device"`
+	Name		string			`json:"name"`
+	Connected	time.Time		`json:"connected"`
+	Updated		time.Time		`json:"updated"`
+	Status		RemoteStatus	`json:"status"`
+}
+
+type remoteSession struct {
+	info		RemoteDevice
+	commands	chan RemoteCommand
+}
+
+type RemoteHub struct {
+	sessions	map[string] *remoteSession // by device
+	lastID		uint64
+	mu			sync.Mutex
+}
+
+var gRemoteHub = NewRemoteHub()
+
+func NewRemoteHub() *RemoteHub {
+
+	hub := &RemoteHub{}
+
+	hub.sessions = make(map[string]*remoteSession)
+
+	return hub
+
+}
+
+func (hub *RemoteHub) Register(device, name string) *remoteSession {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if old, ok := hub.sessions[device]; ok {
+		close(old.commands)
+	}
+
+	now := time.Now()
+	sess := &remoteSession{
+		info:		RemoteDevice{Device: device, Name: name, Connected: now, Updated: now},
+		commands:	make(chan RemoteCommand, REMOTE_SEND_BUFFER),
+	}
+	hub.sessions[device] = sess
+
+	return sess
+
+}
+
+func (hub *RemoteHub) Unregister(sess *remoteSession) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	// Not replaced by a new connection
+	if hub.sessions[sess.info.Device] == sess {
+		delete(hub.sessions, sess.info.Device)
+		close(sess.commands)
+	}
+
+}
+
+func (hub *RemoteHub) Devices() []RemoteDevice {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	devices := make([]RemoteDevice, 0, len(hub.sessions))
+	for _, sess := range hub.sessions {
+		devices = append(devices, sess.info)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Connected.Before(devices[j].Connected)
+	})
+
+	return devices
+
+}
+
+func (hub *RemoteHub) SetStatus(device string, status RemoteStatus) error {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	sess, ok := hub.sessions[device]
+	if !ok {
+		return fmt.Errorf("Device not connected %s", device)
+	}
+	sess.info.Status = status
+	sess.info.Updated = time.Now()
+
+	return nil
+
+}
+
+func validateRemoteCommand(cmd RemoteCommand) error {
+
+	switch cmd.Command {
+	case REMOTE_PAUSE, REMOTE_NEXT, REMOTE_PREV:
+		return nil
+	case REMOTE_SEEK:
+		if math.IsNaN(cmd.Position) || math.IsInf(cmd.Position, 0) || cmd.Position < 0 {
+			return fmt.Errorf("Invalid position %v", cmd.Position)
+		}
+		return nil
+	case REMOTE_PLAY, REMOTE_ENQUEUE:
+		if cmd.Command == REMOTE_PLAY && cmd.Base == "" {
+			return nil
+		}
+		dir, err := getAlbumDir(cmd.Album)
+		if err != nil {
+			return err
+		}
+		meta, ok := gMetadataManager.GetMetadata(dir, cmd.Base)
+		if !ok || !isAudio(meta.MimeType) {
+			return fmt.Errorf("Not an audio file %s", cmd.Base)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown command %q", cmd.Command)
+
+}
+
+// Send queues the command for the device, never blocks
+func (hub *RemoteHub) Send(device string, cmd RemoteCommand) (RemoteCommand, error) {
+
+	if err := validateRemoteCommand(cmd); err != nil {
+		return cmd, err
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	sess, ok := hub.sessions[device]
+	if !ok {
+		return cmd, fmt.Errorf("Device not connected %s", device)
+	}
+
+	hub.lastID++
+	cmd.ID = hub.lastID
+
+	select {
+	case sess.commands <- cmd:
+	default:
+		return cmd, fmt.Errorf("Device is not receiving %s", device)
+	}
+
+	return cmd, nil
+
+}
+
+func apiDevices(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodGet {
+		serveJson(w, r, gRemoteHub.Devices())
+		return
+	}
+
+	// ---
+	device := r.URL.Query().Get(QUERY_DEVICE)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		logHTTPRequest(r, -1, "Failed to read body", err)
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+
+		var status RemoteStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			logHTTPRequest(r, -1, "Failed to parse json", err)
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := gRemoteHub.SetStatus(device, status); err != nil {
+			logHTTPRequest(r, -1, "Failed to set status err:", err)
+			http.Error(w, "Device not connected", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPost:
+
+		var cmd RemoteCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			logHTTPRequest(r, -1, "Failed to parse json", err)
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		cmd, err = gRemoteHub.Send(device, cmd)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to send command err:", err)
+			http.Error(w, "Failed to send command", http.StatusBadRequest)
+			return
+		}
+		logHTTPRequest(r, -1, "REMOTE", device, cmd.Command)
+		serveJson(w, r, cmd)
+
+	default:
+		logHTTPRequest(r, -1, "Invalid method for devices")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+
+}
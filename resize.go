@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Image resizing
+//
+// GET /view/B?album=A&w=640&h=640&fmt=webp returns the image B fitted in 640x640 as webp
+//
+// Either of w and h may be omitted and images are never enlarged. JPEG output of JPEG and PNG
+// is made in pure Go so that it works without the native ffmpeg, others are made by ffmpeg.
+// Variants are cached at MetadataDir/resize/CRC_SIZE_WxH.EXT, the ETag is made of the same parts.
+
+const QUERY_WIDTH = "w"
+const QUERY_HEIGHT = "h"
+const QUERY_IMAGE_FORMAT = "fmt"
+const RESIZE_DIR = "resize"
+const RESIZE_MAX_SIZE = 4096
+const RESIZE_JPEG_QUALITY = 85
+
+const IMAGE_FORMAT_JPEG = "jpeg"
+const IMAGE_FORMAT_WEBP = "webp"
+
+type resizeFormat struct {
+	Ext			string
+	MimeType	string
+	Args		[]string // of ffmpeg
+}
+
+var gResizeFormats = map[string]resizeFormat{
+	IMAGE_FORMAT_JPEG:	{".jpg", "image/jpeg", []string{"-c:v", "mjpeg", "-q:v", "3", "-pix_fmt", "yuvj420p"}},
+	IMAGE_FORMAT_WEBP:	{".webp", "image/webp", []string{"-c:v", "libwebp", "-q:v", "80"}},
+}
+
+var gResizes = make(map[string]chan struct{}) // in progress by cache path
+var gResizesMu sync.Mutex
+var gResizeSemaphore = NewSemaphore(PERF_RESIZE_MAX_CONCURRENT, 0)
+
+// parseResizeSize returns 0 for the omitted one
+func parseResizeSize(value string) (int, error) {
+
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 || size > RESIZE_MAX_SIZE {
+		return 0, fmt.Errorf("Invalid size %q", value)
+	}
+
+	return size, nil
+
+}
+
+// fitSize fits sw x sh in w x h keeping the ratio, never enlarges
+func fitSize(sw, sh, w, h int) (int, int) {
+
+	scale := 1.0
+	if w > 0 {
+		scale = math.Min(scale, float64(w) / float64(sw))
+	}
+	if h > 0 {
+		scale = math.Min(scale, float64(h) / float64(sh))
+	}
+
+	dw := int(math.Max(1, math.Round(float64(sw) * scale)))
+	dh := int(math.Max(1, math.Round(float64(sh) * scale)))
+
+	return dw, dh
+
+}
+
+func serveResize(w http.ResponseWriter, r *http.Request, album, base string) {
+
+	query := r.URL.Query()
+	width, err := parseResizeSize(query.Get(QUERY_WIDTH))
+	if err != nil {
+		logHTTPRequest(r, -1, "resize", err)
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+	height, err := parseResizeSize(query.Get(QUERY_HEIGHT))
+	if err != nil {
+		logHTTPRequest(r, -1, "resize", err)
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	formatName := query.Get(QUERY_IMAGE_FORMAT)
+	if formatName == "" {
+		formatName = IMAGE_FORMAT_JPEG
+	}
+	format, ok := gResizeFormats[formatName]
+	if !ok {
+		logHTTPRequest(r, -1, "Unknown image format", formatName)
+		http.Error(w, "Unknown image format", http.StatusBadRequest)
+		return
+	}
+
+	dir, err := getAlbumDir(album)
+	if err != nil {
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+	meta, ok := gMetadataManager.GetMetadata(dir, base)
+	if !ok || meta.IsDir {
+		logHTTPRequest(r, -1, "resize Not Found", dir, base)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if strings.SplitN(meta.MimeType, "/", 2)[0] != MIME_IMAGE {
+		http.Error(w, "Not an image", http.StatusBadRequest)
+		return
+	}
+	if meta.Crc32 == "" {
+		logHTTPRequest(r, -1, "resize crc not ready", dir, base)
+		http.Error(w, "File is being indexed", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Same variant of the same content
+	variant := fmt.Sprintf("%s_%dx%d", meta.contentKey(), width, height)
+	cachePath := filepath.Join(gAppInfo.MetadataDir, RESIZE_DIR, variant + format.Ext)
+	etag := `"` + variant + format.Ext + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	touchCache(cachePath)
+	err = ensureResized(r.Context(), filepath.Join(dir, base), meta.MimeType, cachePath, width, height, formatName)
+	if r.Context().Err() != nil {
+		// Client is gone
+		return
+	} else if errors.Is(err, errNoNativeFFmpeg) {
+		logHTTPRequest(r, -1, "resize", err)
+		http.Error(w, "Resizing to " + formatName + " is not available", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		logHTTPRequest(r, -1, "Failed to resize", base, err)
+		http.Error(w, "Failed to resize", http.StatusUnprocessableEntity)
+		return
+	}
+
+	file, err := ioOpen(cachePath)
+	if err != nil {
+		logHTTPRequest(r, -1, "resize ioOpen", cachePath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logHTTPRequest(r, -1, "resize file.Stat", cachePath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if checkNotModified(r, info.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.MimeType)
+	http.ServeContent(w, r, filepath.Base(cachePath), info.ModTime(), file)
+
+}
+
+// ensureResized makes the variant unless cached, waiting for the one in progress until ctx is done
+func ensureResized(ctx context.Context, fullpath, mimeType, cachePath string, width, height int, formatName string) error {
+
+	var done chan struct{}
+	for {
+		var busy bool
+		gResizesMu.Lock()
+		done, busy = gResizes[cachePath]
+		if !busy {
+			if _, err := ioStat(cachePath); err == nil {
+				gResizesMu.Unlock()
+				return nil
+			}
+			done = make(chan struct{})
+			gResizes[cachePath] = done
+			gResizesMu.Unlock()
+			break
+		}
+		gResizesMu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	defer func() {
+		gResizesMu.Lock()
+		delete(gResizes, cachePath)
+		gResizesMu.Unlock()
+		close(done)
+	}()
+
+	err := os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	partPath := cachePath + ".part"
+	defer ioRemove(partPath) // no-op once renamed
+
+	if formatName == IMAGE_FORMAT_JPEG && (mimeType == "image/jpeg" || mimeType == "image/png") {
+		// Decoded images are large, e.g. 18 MB for 12 MP
+		if !gResizeSemaphore.AcquireContext(ctx) {
+			return ctx.Err()
+		}
+		err = resizeNative(fullpath, partPath, width, height)
+		gResizeSemaphore.Release()
+	} else {
+		err = resizeFFmpeg(fullpath, partPath, width, height, gResizeFormats[formatName])
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(partPath, cachePath)
+
+}
+
+func resizeFFmpeg(fullpath, outpath string, width, height int, format resizeFormat) error {
+
+	devNull, err := ioOpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	// Commas in expressions are escaped in filtergraphs
+	scaleW, scaleH := "iw", "ih"
+	if width > 0 {
+		scaleW = fmt.Sprintf("min(iw\\,%d)", width)
+	}
+	if height > 0 {
+		scaleH = fmt.Sprintf("min(ih\\,%d)", height)
+	}
+
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "error",
+		"-i", fullpath,
+		"-vf", "scale=" + scaleW + ":" + scaleH + ":force_original_aspect_ratio=decrease",
+		"-frames:v", "1",
+	}
+	args = append(args, format.Args...)
+	args = append(args, "-f", "image2", outpath)
+
+	err = executeFFmpegInteractive(args, devNull, devNull)
+	if err == nil && !fileNotEmpty(outpath) {
+		err = fmt.Errorf("%s is not created", format.Ext)
+	}
+
+	return err
+
+}
+
+func resizeNative(fullpath, outpath string, width, height int) error {
+
+	file, err := ioOpen(fullpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var src image.Image
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(4)
+	isPNG := bytes.HasPrefix(magic, []byte("\x89PNG"))
+	if isPNG {
+		src, err = png.Decode(reader)
+	} else {
+		src, err = jpeg.Decode(reader)
+	}
+	if err != nil {
+		return err
+	}
+
+	// EXIF is not kept so the orientation is applied
+	orientation := 1
+	if !isPNG {
+		if exif, err := readExif(fullpath, "image/jpeg"); err == nil && exif.Orientation != 0 {
+			orientation = exif.Orientation
+		}
+	}
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	bounds := src.Bounds()
+	dw, dh := fitSize(bounds.Dx(), bounds.Dy(), width, height)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, orientImage(downscaleImage(src, dw, dh), orientation), &jpeg.Options{Quality: RESIZE_JPEG_QUALITY})
+	if err != nil {
+		return err
+	}
+
+	return ioWriteFile(outpath, buf.Bytes(), 0644)
+
+}
+
+// pixelReader returns the reader of premultiplied 8 bit RGBA by the coordinates of the bounds,
+// decoded types are read in place without converting the whole image
+func pixelReader(src image.Image) func(x, y int) (int, int, int, int) {
+
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (int, int, int, int) {
+			yi, ci := img.YOffset(x, y), img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+			return int(r), int(g), int(b), 255
+		}
+	case *image.Gray:
+		return func(x, y int) (int, int, int, int) {
+			v := int(img.Pix[img.PixOffset(x, y)])
+			return v, v, v, 255
+		}
+	case *image.RGBA:
+		return func(x, y int) (int, int, int, int) {
+			i := img.PixOffset(x, y)
+			return int(img.Pix[i]), int(img.Pix[i + 1]), int(img.Pix[i + 2]), int(img.Pix[i + 3])
+		}
+	case *image.NRGBA:
+		return func(x, y int) (int, int, int, int) {
+			i := img.PixOffset(x, y)
+			a := int(img.Pix[i + 3])
+			return int(img.Pix[i]) * a / 255, int(img.Pix[i + 1]) * a / 255, int(img.Pix[i + 2]) * a / 255, a
+		}
+	}
+
+	return func(x, y int) (int, int, int, int) {
+		r, g, b, a := src.At(x, y).RGBA()
+		return int(r >> 8), int(g >> 8), int(b >> 8), int(a >> 8)
+	}
+
+}
+
+// downscaleImage averages the source pixels covered by each pixel, transparency is put on white
+func downscaleImage(src image.Image, dw, dh int) *image.RGBA {
+
+	bounds := src.Bounds()
+	read := pixelReader(src)
+
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0 := y * sh / dh
+		y1 := max((y + 1) * sh / dh, y0 + 1)
+		for x := 0; x < dw; x++ {
+			x0 := x * sw / dw
+			x1 := max((x + 1) * sw / dw, x0 + 1)
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r1, g1, b1, a1 := read(bounds.Min.X + sx, bounds.Min.Y + sy)
+					r += r1
+					g += g1
+					b += b1
+					a += a1
+					n++
+				}
+			}
+
+			// Premultiplied so that white is added as much as it is transparent
+			white := 255 - a / n
+			i := dst.PixOffset(x, y)
+			dst.Pix[i]		= uint8(r / n + white)
+			dst.Pix[i + 1]	= uint8(g / n + white)
+			dst.Pix[i + 2]	= uint8(b / n + white)
+			dst.Pix[i + 3]	= 255
+		}
+	}
+
+	return dst
+
+}
+
+// orientImage turns the image as the EXIF orientation tells
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w - 1 - x, y
+			case 3:
+				dx, dy = w - 1 - x, h - 1 - y
+			case 4:
+				dx, dy = x, h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h - 1 - y, x
+			case 7:
+				dx, dy = h - 1 - y, w - 1 - x
+			case 8:
+				dx, dy = y, w - 1 - x
+			}
+			i, j := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[j:j + 4], src.Pix[i:i + 4])
+		}
+	}
+
+	return dst
+
+}
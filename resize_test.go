@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFitSize(t *testing.T) {
+
+	tests := []struct {
+		name			string
+		sw, sh, w, h	int
+		dw, dh			int
+	}{
+		{"width", 4000, 3000, 640, 0, 640, 480},
+		{"height", 4000, 3000, 0, 300, 400, 300},
+		{"box of landscape", 4000, 3000, 640, 640, 640, 480},
+		{"box of portrait", 3000, 4000, 640, 640, 480, 640},
+		{"never enlarges", 320, 240, 640, 640, 320, 240},
+		{"no size", 320, 240, 0, 0, 320, 240},
+		{"rounded", 1000, 333, 100, 0, 100, 33},
+		{"at least a pixel", 10000, 10, 100, 0, 100, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dw, dh := fitSize(tt.sw, tt.sh, tt.w, tt.h)
+			if dw != tt.dw || dh != tt.dh {
+				t.Errorf("got %dx%d, want %dx%d", dw, dh, tt.dw, tt.dh)
+			}
+		})
+	}
+
+}
+
+func TestEnsureResizedGivesUpWaiting(t *testing.T) {
+
+	cachePath := filepath.Join(t.TempDir(), "A_640x0.jpg")
+	done := make(chan struct{})
+	gResizesMu.Lock()
+	gResizes[cachePath] = done
+	gResizesMu.Unlock()
+	defer func() {
+		gResizesMu.Lock()
+		delete(gResizes, cachePath)
+		gResizesMu.Unlock()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+	defer cancel()
+	err := ensureResized(ctx, "a.jpg", "image/jpeg", cachePath, 640, 0, IMAGE_FORMAT_JPEG)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+
+}
@@ -24,6 +24,7 @@ type AppInfo struct {
 	UploadCount int // Total count of uploads since startup // TODO atomic
 	UploadDir string
 	MetadataDir string
+	MetadataStore string
 	TermSpawner bool
 	Debug bool
 	Debug2 string // TODO Later deprecate replace debug
@@ -235,12 +236,35 @@ func recursiveNewName(dir string, fn string) string {
 	return fmt.Sprintf("%s-%d%s", stem, time.Now().Unix(), ext)
 }
 
+// cleanAlbumPath confines the album path, which can be nested, to the upload directory
+func cleanAlbumPath(album string) string {
+	return filepath.Clean(string(filepath.Separator) + filepath.FromSlash(album))[1:]
+}
+
+// getAlbumDir returns the upload directory of the album
+func getAlbumDir(album string) (string, error) {
+	album = cleanAlbumPath(album)
+	if strings.Contains(album, META_SLASH_IN_FILENAME) {
+		return "", fmt.Errorf("Album cannot contain %s", META_SLASH_IN_FILENAME)
+	}
+	return filepath.Join(gAppInfo.UploadDir, album), nil
+}
+
 func getUploadFullpath(album, base string) string {
-	return filepath.Join(gAppInfo.UploadDir, album, base)
+	return filepath.Join(gAppInfo.UploadDir, cleanAlbumPath(album), filepath.Base(base))
+}
+
+// getAlbumOfDir returns the album name of the upload directory, empty for the root
+func getAlbumOfDir(dir string) string {
+	album := mustFilepathRel(gAppInfo.UploadDir, dir)
+	if album == "." {
+		return ""
+	}
+	return filepath.ToSlash(album)
 }
 
 func getMetadataFullpath(album, base, ext string) string {
-	return filepath.Join(gAppInfo.MetadataDir, gAppInfo.UploadDir, album, base+ext)
+	return filepath.Join(gAppInfo.MetadataDir, getUploadFullpath(album, base)) + ext
 }
 
 func makeAuthCookie(val string, exp time.Time) *http.Cookie {
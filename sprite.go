@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Video scrubbing previews
+//
+// GET /view/B?album=A&metadata=_sprite.webp  returns the sprite sheet of the video B
+// GET /view/B?album=A&metadata=_sprite.vtt   returns the WebVTT thumbnail track pointing into the sheet
+//
+// Frames are taken every SPRITE_INTERVAL seconds, or at a longer interval for long videos so that
+// a sheet has at most SPRITE_MAX_TILES. The sheet is baked after the ffprobe json and its layout is
+// recorded in Metadata.Sprite, the track is made from it on request so that it follows renames.
+
+const SPRITE_INTERVAL = 10 // seconds
+const SPRITE_MAX_TILES = 100
+const SPRITE_COLUMNS = 10
+const SPRITE_TILE_WIDTH = 160
+const SPRITE_TILE_HEIGHT = 90 // when the size is unknown
+
+type MetadataSprite struct {
+	Interval	int			`json:"interval"` // seconds
+	Count		int			`json:"count"`
+	Columns		int			`json:"columns"`
+	Width		int			`json:"width"` // of a tile
+	Height		int			`json:"height"`
+	Duration	float64		`json:"duration"`
+}
+
+func newSpriteLayout(media *MediaInfo) (*MetadataSprite, error) {
+
+	if media == nil || media.Duration <= 0 {
+		return nil, fmt.Errorf("Unknown duration")
+	}
+
+	sprite := &MetadataSprite{
+		Interval:	SPRITE_INTERVAL,
+		Width:		SPRITE_TILE_WIDTH,
+		Height:		SPRITE_TILE_HEIGHT,
+		Duration:	media.Duration,
+	}
+
+	if longer := int(math.Ceil(media.Duration / SPRITE_MAX_TILES)); longer > sprite.Interval {
+		sprite.Interval = longer
+	}
+	sprite.Count = int(math.Ceil(media.Duration / float64(sprite.Interval)))
+	sprite.Columns = SPRITE_COLUMNS
+	if sprite.Count < sprite.Columns {
+		sprite.Columns = sprite.Count
+	}
+
+	// Even for yuv420p
+	if media.Width > 0 && media.Height > 0 {
+		sprite.Height = int(math.Round(float64(SPRITE_TILE_WIDTH * media.Height) / float64(media.Width) / 2)) * 2
+		if sprite.Height < 2 {
+			sprite.Height = 2
+		}
+	}
+
+	return sprite, nil
+
+}
+
+func (sprite *MetadataSprite) rows() int {
+	return (sprite.Count + sprite.Columns - 1) / sprite.Columns
+}
+
+// bakeSprite makes the sprite sheet of the video at outpath
+func bakeSprite(fullpath, outpath string, media *MediaInfo) (*MetadataSprite, error) {
+
+	sprite, err := newSpriteLayout(media)
+	if err != nil {
+		return nil, err
+	}
+
+	devNull, err := ioOpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer devNull.Close()
+
+	filter := fmt.Sprintf(
+		"fps=1/%d,scale=%d:%d,tile=%dx%d",
+		sprite.Interval, sprite.Width, sprite.Height, sprite.Columns, sprite.rows(),
+	)
+	// Only keyframes are decoded so that long videos do not hold ffmpeg for long,
+	// a tile is of the last keyframe before its time
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "error",
+		"-skip_frame", "nokey",
+		"-i", fullpath,
+		"-an", "-sn",
+		"-vf", filter,
+		"-frames:v", "1",
+		"-c:v", "libwebp",
+		"-threads", "1",
+		"-q:v", "70",
+		outpath,
+	}
+	err = executeFFmpeg(args, devNull, devNull)
+	if err == nil && !fileNotEmpty(outpath) {
+		err = fmt.Errorf("%s is not created", META_EXT_SPRITE)
+	}
+	if err != nil {
+		ioRemove(outpath)
+		return nil, err
+	}
+
+	return sprite, nil
+
+}
+
+func formatVTTTime(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		int(d.Hours()), int(d.Minutes()) % 60, int(d.Seconds()) % 60, d.Milliseconds() % 1000)
+}
+
+func serveSpriteVTT(w http.ResponseWriter, r *http.Request, album, base string) {
+
+	dir, err := getAlbumDir(album)
+	if err != nil {
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+	meta, ok := gMetadataManager.GetMetadata(dir, base)
+	if !ok || meta.Sprite == nil {
+		logHTTPRequest(r, -1, "No sprite of", dir, base)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Follows the sheet
+	info, err := ioStat(filepath.Join(gAppInfo.MetadataDir, dir, base) + META_EXT_SPRITE)
+	if err != nil {
+		logHTTPRequest(r, -1, "Failed to stat sprite err:", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if checkNotModified(r, info.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	sprite := meta.Sprite
+	query := url.Values{}
+	if album != "" {
+		query.Set(QUERY_ALBUM, album)
+	}
+	query.Set(QUERY_METADATA, META_EXT_SPRITE)
+	sheet := (&url.URL{Path: "/view/" + base, RawQuery: query.Encode()}).String()
+
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n")
+	for i := 0; i < sprite.Count; i++ {
+		start := float64(i * sprite.Interval)
+		end := math.Min(start + float64(sprite.Interval), sprite.Duration)
+		x := (i % sprite.Columns) * sprite.Width
+		y := (i / sprite.Columns) * sprite.Height
+		sb.WriteString("\n" + strconv.Itoa(i + 1) + "\n")
+		sb.WriteString(formatVTTTime(start) + " --> " + formatVTTTime(end) + "\n")
+		sb.WriteString(fmt.Sprintf("%s#xywh=%d,%d,%d,%d\n", sheet, x, y, sprite.Width, sprite.Height))
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Write([]byte(sb.String()))
+
+}
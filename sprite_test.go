@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewSpriteLayout(t *testing.T) {
+
+	tests := []struct {
+		name	string
+		media	*MediaInfo
+		want	MetadataSprite
+		err		bool
+	}{
+		{"no media", nil, MetadataSprite{}, true},
+		{"unknown duration", &MediaInfo{Width: 1920, Height: 1080}, MetadataSprite{}, true},
+		{"short", &MediaInfo{Duration: 25, Width: 1920, Height: 1080}, MetadataSprite{10, 3, 3, 160, 90, 25}, false},
+		{"columns", &MediaInfo{Duration: 125.5, Width: 1280, Height: 720}, MetadataSprite{10, 13, 10, 160, 90, 125.5}, false},
+		{"long", &MediaInfo{Duration: 7200, Width: 1920, Height: 1080}, MetadataSprite{72, 100, 10, 160, 90, 7200}, false},
+		{"longer interval rounded up", &MediaInfo{Duration: 1001, Width: 1920, Height: 1080}, MetadataSprite{11, 91, 10, 160, 90, 1001}, false},
+		{"portrait", &MediaInfo{Duration: 30, Width: 1080, Height: 1920}, MetadataSprite{10, 3, 3, 160, 284, 30}, false},
+		{"even height", &MediaInfo{Duration: 30, Width: 640, Height: 480}, MetadataSprite{10, 3, 3, 160, 120, 30}, false},
+		{"unknown size", &MediaInfo{Duration: 30}, MetadataSprite{10, 3, 3, 160, 90, 30}, false},
+		{"flat", &MediaInfo{Duration: 30, Width: 10000, Height: 10}, MetadataSprite{10, 3, 3, 160, 2, 30}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newSpriteLayout(tt.media)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("want error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+}
+
+func TestFormatVTTTime(t *testing.T) {
+
+	tests := []struct {
+		seconds	float64
+		want	string
+	}{
+		{0, "00:00:00.000"},
+		{9.5, "00:00:09.500"},
+		{61.0004, "00:01:01.000"},
+		{59.9996, "00:01:00.000"},
+		{3725.25, "01:02:05.250"},
+		{360000, "100:00:00.000"},
+	}
+
+	for _, tt := range tests {
+		if got := formatVTTTime(tt.seconds); got != tt.want {
+			t.Errorf("formatVTTTime(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+
+}
@@ -0,0 +1,114 @@
+(() => { // PARTY
+  // Joins /ws/party when the page is opened with ?party=room, ?lead=1 takes the lead
+
+  const QUERY_PARTY = "party";
+  const QUERY_LEAD = "lead";
+  const PARTY_TIME_SAMPLES = 5;
+  const PARTY_STATE_INTERVAL = 5000;
+  const PARTY_SEEK_THRESHOLD = 0.3; // seconds
+  const PARTY_RECONNECT = 3000;
+
+  const gAudio = document.querySelector(".music-player audio");
+
+  let ws = null;
+  let isLeader = false;
+  let offset = 0; // server clock - local clock in ms
+  let bestRtt = Infinity;
+  let following = Promise.resolve();
+
+  function serverNow() {
+    return Date.now() + offset;
+  }
+
+  function send(type, value) {
+    if (ws && ws.readyState === WebSocket.OPEN)
+      ws.send(JSON.stringify({type, [type]: value}));
+  }
+
+  // Clock offset of the sample with the shortest round trip
+  function probeTime() {
+    for (let i = 0; i < PARTY_TIME_SAMPLES; i++)
+      setTimeout(() => send("time", {client: Date.now()}), i * 200);
+  }
+  function onTime(time) {
+    const now = Date.now();
+    const rtt = now - time.client;
+    if (rtt < bestRtt) {
+      bestRtt = rtt;
+      offset = time.server - (time.client + now) / 2;
+    }
+  }
+
+  function sendState() {
+    if (!isLeader || gAudioCurrentBase === null)
+      return;
+    send("state", {
+      album: gAlbum || "",
+      base: gAudioCurrentBase,
+      position: gAudio.currentTime || 0,
+      playing: !gAudio.paused,
+      at: Math.round(serverNow())
+    });
+  }
+  for (const type of ["playing", "pause", "seeked"])
+    gAudio.addEventListener(type, sendState);
+  setInterval(sendState, PARTY_STATE_INTERVAL);
+
+  async function follow(state) {
+    if (isLeader)
+      return;
+
+    if ((state.album || null) !== (gAlbum || null))
+      await changeAlbum(state.album || null);
+    if (state.base !== gAudioCurrentBase)
+      await changeMusic(state.base);
+
+    const target = state.position + (state.playing ? (serverNow() - state.at) / 1000 : 0);
+    if (Math.abs(gAudio.currentTime - target) > PARTY_SEEK_THRESHOLD)
+      gAudio.currentTime = target;
+
+    if (state.playing && gAudio.paused)
+      await mediaActionHandlers["play"]();
+    else if (!state.playing && !gAudio.paused)
+      await mediaActionHandlers["pause"]();
+  }
+
+  function connect(room, lead) {
+    const url = buildURL("/ws/party", {room, device: gDeviceId, lead: lead ? "1" : ""});
+    url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+
+    ws = new WebSocket(url);
+    ws.addEventListener("open", probeTime);
+    ws.addEventListener("message", event => {
+      const msg = JSON.parse(event.data);
+      switch (msg.type) {
+      case "time":
+        onTime(msg.time);
+        break;
+      case "members":
+        isLeader = msg.members.leader === gDeviceId;
+        console.log("Party", room, isLeader ? "leading" : "following", msg.members.devices);
+        sendState();
+        break;
+      case "state":
+        // One at a time as changing tracks takes a while
+        following = following.then(() => follow(msg.state)).catch(console.error);
+        break;
+      case "error":
+        console.error("Party", msg.error);
+        break;
+      }
+    });
+    ws.addEventListener("close", () => {
+      bestRtt = Infinity;
+      setTimeout(() => connect(room, false), PARTY_RECONNECT);
+    });
+  }
+
+  window.addEventListener("load", () => {
+    const room = getQueryParam(QUERY_PARTY);
+    if (room)
+      connect(room, getQueryParam(QUERY_LEAD) === "1");
+  });
+
+})();
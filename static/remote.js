@@ -0,0 +1,67 @@
+(() => { // REMOTE
+  // Runs the commands which other devices send through /api/devices to this page,
+  // it is registered as the player gPlayerId by the stream of /api/events
+
+  const URL_API_DEVICES = "/api/devices";
+  const REMOTE_STATUS_INTERVAL = 10000;
+
+  const gAudio = document.querySelector(".music-player audio");
+
+  async function reportStatus() {
+    try {
+      await fetch(buildURL(URL_API_DEVICES, {device: gPlayerId}), {
+        method: "PUT",
+        body: JSON.stringify({
+          album: gAlbum || "",
+          base: gAudioCurrentBase || "",
+          position: gAudio.currentTime || 0,
+          playing: !gAudio.paused
+        })
+      });
+    } catch {}
+  }
+  for (const type of ["playing", "pause", "seeked"])
+    gAudio.addEventListener(type, reportStatus);
+  setInterval(reportStatus, REMOTE_STATUS_INTERVAL);
+
+  async function run(cmd) {
+    switch (cmd.command) {
+    case "play":
+      if (cmd.base) {
+        if ((cmd.album || null) !== (gAlbum || null))
+          await changeAlbum(cmd.album || null);
+        await changeMusic(cmd.base);
+      } else {
+        await mediaActionHandlers["play"]();
+      }
+      break;
+    case "pause":
+      await mediaActionHandlers["pause"]();
+      break;
+    case "next":
+      await mediaActionHandlers["nexttrack"]();
+      break;
+    case "prev":
+      await mediaActionHandlers["previoustrack"]();
+      break;
+    case "seek":
+      gAudio.currentTime = cmd.position;
+      break;
+    case "enqueue":
+      if ((cmd.album || null) !== (gAlbum || null)) {
+        console.error("Remote cannot enqueue from other albums", cmd.album);
+        break;
+      }
+      enqueueMusic(cmd.base);
+      break;
+    }
+  }
+
+  let running = Promise.resolve();
+  gEvents.addEventListener("open", reportStatus);
+  gEvents.addEventListener("command", event => {
+    const cmd = JSON.parse(event.data);
+    running = running.then(() => run(cmd)).catch(console.error);
+  });
+
+})();
@@ -0,0 +1,75 @@
+(() => { // WAVEFORM
+  // Draws the waveform of the playing track in the seeker, played part darker
+
+  const EXT_META_WAVEFORM = "_waveform.json";
+
+  const gAudio = document.querySelector(".music-player audio");
+  const seeker = document.querySelector(".music-player .seeker");
+  const canvas = createElement("canvas", "waveform");
+  seeker.prepend(canvas);
+
+  let waveform = null;
+  let loadedSrc = null;
+
+  async function load() {
+    const meta = gAudioCurrentBase !== null && gMetadataBody.metaMap[gAudioCurrentBase];
+    const src = (meta && meta.waveform) ? buildURL(
+      [URL_VIEW, gAudioCurrentBase],
+      {[QUERY_ALBUM]: gAlbum, [QUERY_METADATA]: EXT_META_WAVEFORM}
+    ).href : null;
+    if (src === loadedSrc)
+      return;
+
+    loadedSrc = src;
+    waveform = null;
+    if (src) {
+      try {
+        const res = await fetch(src);
+        const json = await res.json();
+        // Not changed while fetching
+        if (res.ok && loadedSrc === src)
+          waveform = json;
+      } catch {}
+    }
+    seeker.classList.toggle("waveform", waveform !== null);
+    draw();
+  }
+
+  function draw() {
+    if (!waveform)
+      return;
+
+    const width = canvas.clientWidth;
+    const height = canvas.clientHeight;
+    canvas.width = width * devicePixelRatio;
+    canvas.height = height * devicePixelRatio;
+    const ctx = canvas.getContext("2d");
+    ctx.scale(devicePixelRatio, devicePixelRatio);
+
+    const played = gAudio.duration ? gAudio.currentTime / gAudio.duration : 0;
+    const length = waveform.length;
+    for (let x = 0; x < width; x++) {
+      // Loudest of the buckets in the column
+      const i0 = Math.floor(x / width * length);
+      const i1 = Math.max(i0 + 1, Math.floor((x + 1) / width * length));
+      let peak = 0, rms = 0;
+      for (let i = i0; i < i1 && i < length; i++) {
+        peak = Math.max(peak, -waveform.data[i * 2], waveform.data[i * 2 + 1]);
+        rms = Math.max(rms, waveform.rms[i]);
+      }
+      const isPlayed = x / width < played;
+      const peakHeight = Math.max(1, peak / 128 * height);
+      const rmsHeight = rms / 128 * height;
+      ctx.fillStyle = isPlayed ? "#999" : "#e3e3e3";
+      ctx.fillRect(x, (height - peakHeight) / 2, 1, peakHeight);
+      ctx.fillStyle = isPlayed ? "#555" : "#c3c3c3";
+      ctx.fillRect(x, (height - rmsHeight) / 2, 1, rmsHeight);
+    }
+  }
+
+  gAudio.addEventListener("loadstart", load);
+  gAudio.addEventListener("timeupdate", draw);
+  gAudio.addEventListener("seeked", draw);
+  window.addEventListener("resize", draw);
+
+})();
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Photo timeline
+//
+// GET /api/timeline                        returns the photos of all albums grouped by day, newest first
+// GET /api/timeline?album=A                only of the album A
+// GET /api/timeline?before=2024-05-01      days before the day, for the next page
+// GET /api/timeline?days=30                number of days in a page
+//
+// Photos are ordered by the capture time of EXIF, those without it by the modification time.
+// Days are of the wall clock where the photo was taken.
+
+const TIMELINE_DEFAULT_DAYS = 30
+const TIMELINE_DAY_LAYOUT = "2006-01-02"
+
+type TimelinePhoto struct {
+	Album		string			`json:"album"`
+	Base		string			`json:"base"`
+	MimeType	string			`json:"mimeType"`
+	Time		string			`json:"time"` // taken, or modified when not known
+	Exif		*MetadataExif	`json:"exif,omitempty"`
+	Display		*MetadataDisplay	`json:"display,omitempty"`
+}
+
+type TimelineDay struct {
+	Day			string			`json:"day"`
+	Photos		[]TimelinePhoto	`json:"photos"`
+}
+
+// timelinePhotos returns the photos of the album or of all albums
+func (mgr *MetadataManager) timelinePhotos(album string, all bool) []TimelinePhoto {
+
+	mgr.cacheMapMu.RLock()
+	caches := make([]*metadataCache, 0, len(mgr.cacheMap))
+	for dir, cache := range mgr.cacheMap {
+		if all || dir == filepath.Join(gAppInfo.UploadDir, cleanAlbumPath(album)) {
+			caches = append(caches, cache)
+		}
+	}
+	mgr.cacheMapMu.RUnlock()
+
+	photos := make([]TimelinePhoto, 0)
+	for _, cache := range caches {
+		album := getAlbumOfDir(cache.dir)
+		cache.bodyMu.Lock()
+		for base, meta := range cache.body.MetaMap {
+			if meta.IsDir || strings.SplitN(meta.MimeType, "/", 2)[0] != MIME_IMAGE {
+				continue
+			}
+			photo := TimelinePhoto{
+				Album:		album,
+				Base:		base,
+				MimeType:	meta.MimeType,
+				Time:		meta.ModTime.Local().Format(time.RFC3339),
+				Exif:		meta.Exif,
+				Display:	meta.Display,
+			}
+			if meta.Exif != nil && meta.Exif.Taken != "" {
+				photo.Time = meta.Exif.Taken
+			}
+			photos = append(photos, photo)
+		}
+		cache.bodyMu.Unlock()
+	}
+
+	return photos
+
+}
+
+// groupTimeline groups the photos by day newest first, days before the given one when not empty
+func groupTimeline(photos []TimelinePhoto, before string, days int) []TimelineDay {
+
+	// Wall clock times sort as strings
+	sort.Slice(photos, func(i, j int) bool {
+		if photos[i].Time != photos[j].Time {
+			return photos[i].Time > photos[j].Time
+		}
+		if photos[i].Album != photos[j].Album {
+			return photos[i].Album < photos[j].Album
+		}
+		return photos[i].Base < photos[j].Base
+	})
+
+	groups := make([]TimelineDay, 0)
+	for _, photo := range photos {
+		day := photo.Time[:len(TIMELINE_DAY_LAYOUT)]
+		if before != "" && day >= before {
+			continue
+		}
+		if len(groups) == 0 || groups[len(groups) - 1].Day != day {
+			if len(groups) == days {
+				break
+			}
+			groups = append(groups, TimelineDay{Day: day})
+		}
+		last := &groups[len(groups) - 1]
+		last.Photos = append(last.Photos, photo)
+	}
+
+	return groups
+
+}
+
+func apiTimeline(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	days, err := parseQueryInt(r, QUERY_DAYS, TIMELINE_DEFAULT_DAYS)
+	if err != nil || days == 0 {
+		http.Error(w, "Invalid days", http.StatusBadRequest)
+		return
+	}
+	before := query.Get(QUERY_BEFORE)
+	if _, err := time.Parse(TIMELINE_DAY_LAYOUT, before); before != "" && err != nil {
+		http.Error(w, "Invalid before", http.StatusBadRequest)
+		return
+	}
+
+	photos := gMetadataManager.timelinePhotos(query.Get(QUERY_ALBUM), !query.Has(QUERY_ALBUM))
+	serveJson(w, r, groupTimeline(photos, before, days))
+
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGroupTimeline(t *testing.T) {
+
+	photos := func() []TimelinePhoto {
+		return []TimelinePhoto{
+			{Album: "b", Base: "1.jpg", Time: "2024-05-01T09:00:00"},
+			{Album: "a", Base: "2.jpg", Time: "2024-05-02T23:59:59+09:00"},
+			{Album: "a", Base: "3.jpg", Time: "2024-05-01T09:00:00"},
+			{Album: "a", Base: "1.jpg", Time: "2024-05-01T09:00:00"},
+			{Album: "a", Base: "4.jpg", Time: "2024-04-30T00:00:00-07:00"},
+			{Album: "", Base: "5.jpg", Time: "2023-12-31T12:00:00"},
+		}
+	}
+
+	tests := []struct {
+		name	string
+		before	string
+		days	int
+		want	map[string][]string // album/base by day
+		order	[]string
+	}{
+		{
+			"all",
+			"", 30,
+			map[string][]string{
+				"2024-05-02": {"a/2.jpg"},
+				"2024-05-01": {"a/1.jpg", "a/3.jpg", "b/1.jpg"},
+				"2024-04-30": {"a/4.jpg"},
+				"2023-12-31": {"/5.jpg"},
+			},
+			[]string{"2024-05-02", "2024-05-01", "2024-04-30", "2023-12-31"},
+		},
+		{
+			"days",
+			"", 2,
+			map[string][]string{
+				"2024-05-02": {"a/2.jpg"},
+				"2024-05-01": {"a/1.jpg", "a/3.jpg", "b/1.jpg"},
+			},
+			[]string{"2024-05-02", "2024-05-01"},
+		},
+		{
+			"before",
+			"2024-05-01", 1,
+			map[string][]string{
+				"2024-04-30": {"a/4.jpg"},
+			},
+			[]string{"2024-04-30"},
+		},
+		{
+			"before all",
+			"2000-01-01", 30,
+			map[string][]string{},
+			[]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := groupTimeline(photos(), tt.before, tt.days)
+			order := make([]string, 0)
+			for _, group := range groups {
+				order = append(order, group.Day)
+				names := make([]string, 0)
+				for _, photo := range group.Photos {
+					names = append(names, photo.Album + "/" + photo.Base)
+				}
+				if !slices.Equal(names, tt.want[group.Day]) {
+					t.Errorf("%s got %q, want %q", group.Day, names, tt.want[group.Day])
+				}
+			}
+			if !slices.Equal(order, tt.order) {
+				t.Errorf("got days %q, want %q", order, tt.order)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Transcoding
+//
+// GET /view/B?album=A&transcode=aac&bitrate=192k streams B transcoded by native ffmpeg
+//
+// The output is written to MetadataDir/transcode/CRC_SIZE_BITRATE.EXT as it streams, and renamed
+// when ffmpeg finishes even if the client is gone. Finished ones are served with Range support.
+// Requests for one being transcoded wait for it.
+
+const QUERY_TRANSCODE = "transcode"
+const QUERY_BITRATE = "bitrate"
+const TRANSCODE_DIR = "transcode"
+const TRANSCODE_DEFAULT_BITRATE = "192k"
+const TRANSCODE_MIN_KBPS = 32
+const TRANSCODE_MAX_KBPS = 320
+const TRANSCODE_CHUNK = 64 * 1024
+
+type transcodeFormat struct {
+	Codec		string
+	Format		string
+	Ext			string
+	MimeType	string
+}
+
+var gTranscodeFormats = map[string]transcodeFormat{
+	"aac":	{"aac", "adts", ".aac", "audio/aac"},
+	"mp3":	{"libmp3lame", "mp3", ".mp3", "audio/mpeg"},
+	"opus":	{"libopus", "ogg", ".ogg", "audio/ogg"},
+}
+
+var gTranscodeBitrateRegex = regexp.MustCompile(`^([0-9]{2,3})k$`)
+
+var gTranscodes = make(map[string]chan struct{}) // in progress by cache path
+var gTranscodesMu sync.Mutex
+
+func transcodeCachePath(key, bitrate string, format transcodeFormat) string {
+	return filepath.Join(gAppInfo.MetadataDir, TRANSCODE_DIR, key + "_" + bitrate + format.Ext)
+}
+
+func serveTranscode(w http.ResponseWriter, r *http.Request, album, base string) {
+
+	query := r.URL.Query()
+	format, ok := gTranscodeFormats[query.Get(QUERY_TRANSCODE)]
+	if !ok {
+		logHTTPRequest(r, -1, "Unknown transcode format", query.Get(QUERY_TRANSCODE))
+		http.Error(w, "Unknown transcode format", http.StatusBadRequest)
+		return
+	}
+	bitrate := query.Get(QUERY_BITRATE)
+	if bitrate == "" {
+		bitrate = TRANSCODE_DEFAULT_BITRATE
+	}
+	matches := gTranscodeBitrateRegex.FindStringSubmatch(bitrate)
+	if matches == nil {
+		http.Error(w, "Invalid bitrate", http.StatusBadRequest)
+		return
+	}
+	if kbps, _ := strconv.Atoi(matches[1]); kbps < TRANSCODE_MIN_KBPS || kbps > TRANSCODE_MAX_KBPS {
+		http.Error(w, "Invalid bitrate", http.StatusBadRequest)
+		return
+	}
+
+	dir, err := getAlbumDir(album)
+	if err != nil {
+		http.Error(w, "Invalid album", http.StatusBadRequest)
+		return
+	}
+	meta, ok := gMetadataManager.GetMetadata(dir, base)
+	if !ok || meta.IsDir {
+		logHTTPRequest(r, -1, "transcode Not Found", dir, base)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if meta.Crc32 == "" {
+		logHTTPRequest(r, -1, "transcode crc not ready", dir, base)
+		http.Error(w, "File is being indexed", http.StatusServiceUnavailable)
+		return
+	}
+	cachePath := transcodeCachePath(meta.contentKey(), bitrate, format)
+	touchCache(cachePath)
+
+	// Wait for the one in progress
+	for {
+		gTranscodesMu.Lock()
+		done, busy := gTranscodes[cachePath]
+		if !busy {
+			if _, err := ioStat(cachePath); err != nil {
+				// Transcode here
+				done = make(chan struct{})
+				gTranscodes[cachePath] = done
+				gTranscodesMu.Unlock()
+				defer func() {
+					gTranscodesMu.Lock()
+					delete(gTranscodes, cachePath)
+					gTranscodesMu.Unlock()
+					close(done)
+				}()
+				streamTranscode(w, r, filepath.Join(dir, base), cachePath, bitrate, format)
+				return
+			}
+		}
+		gTranscodesMu.Unlock()
+		if !busy {
+			break
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Finished
+	file, err := ioOpen(cachePath)
+	if err != nil {
+		logHTTPRequest(r, -1, "transcode ioOpen", cachePath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logHTTPRequest(r, -1, "transcode file.Stat", cachePath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if checkNotModified(r, info.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.MimeType)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	http.ServeContent(w, r, filepath.Base(cachePath), info.ModTime(), file)
+
+}
+
+// streamTranscode writes the output of ffmpeg to both the response and the cache
+func streamTranscode(w http.ResponseWriter, r *http.Request, fullpath, cachePath, bitrate string, format transcodeFormat) {
+
+	err := os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		logHTTPRequest(r, -1, "transcode MkdirAll err:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	partPath := cachePath + ".part"
+	part, err := ioOpenFile(partPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0644)
+	if err != nil {
+		logHTTPRequest(r, -1, "transcode ioOpenFile err:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer ioRemove(partPath) // no-op once renamed
+	defer part.Close()
+
+	devNull, err := ioOpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer devNull.Close()
+
+	pr, pw, err := ioPipe()
+	if err != nil {
+		logHTTPRequest(r, -1, "transcode ioPipe err:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer pr.Close()
+
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "error",
+		"-i", fullpath, "-vn", "-map_metadata", "-1",
+		"-c:a", format.Codec, "-b:a", bitrate, "-f", format.Format, "pipe:1",
+	}
+	ffErr := make(chan error, 1)
+	go func() {
+		ffErr <- executeFFmpegInteractive(args, pw, devNull)
+		pw.Close()
+	}()
+
+	w.Header().Set("Content-Type", format.MimeType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Accept-Ranges", "none")
+
+	// Keep reading after the client is gone so that the cache is finished
+	flusher, _ := w.(http.Flusher)
+	clientGone := false
+	total := 0
+	buf := make([]byte, TRANSCODE_CHUNK)
+	for {
+		n, err := pr.Read(buf)
+		if n > 0 {
+			total += n
+			if _, err := part.Write(buf[:n]); err != nil {
+				logHTTPRequest(r, -1, "transcode write err:", err)
+				return
+			}
+			if !clientGone {
+				if _, err := w.Write(buf[:n]); err != nil {
+					clientGone = true
+				} else if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logHTTPRequest(r, -1, "transcode read err:", err)
+			return
+		}
+	}
+
+	// Truncated output of a failed ffmpeg is not cached
+	err = <-ffErr
+	if errors.Is(err, errNoNativeFFmpeg) {
+		logHTTPRequest(r, -1, "transcode ffmpeg err:", err)
+		http.Error(w, "Transcoding is not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || total == 0 {
+		logHTTPRequest(r, -1, "transcode failed", fullpath, err, fmt.Sprintf("(%d bytes)", total))
+		if total == 0 {
+			http.Error(w, "Failed to transcode", http.StatusUnprocessableEntity)
+		}
+		return
+	}
+
+	part.Close()
+	err = os.Rename(partPath, cachePath)
+	if err != nil {
+		logHTTPRequest(r, -1, "transcode rename err:", err)
+		return
+	}
+	logHTTPRequest(r, -1, "Transcoded", fullpath, "to", filepath.Base(cachePath), fmt.Sprintf("(%d bytes)", total))
+
+}
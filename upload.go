@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Resumable upload
+//
+// POST   /upload/session?album=A           body {"name","size","crc"} creates a session,
+//                                          ?duplicate= is handled as in duplicate.go
+// GET    /upload/session?id=ID             returns the session and its offset
+// PUT    /upload/session?id=ID&offset=N    body is a chunk, X-Chunk-Crc32 header is its crc
+// PUT    /upload/session?id=ID&metadata=E  body is a sidecar metadata file of extension E
+// DELETE /upload/session?id=ID             aborts the session
+//
+// Chunks are appended to the .inprogress file and the running crc is kept in
+// the session so that the whole file doesn't need to be read again at the end.
+// The file is renamed and its metadata set only when the whole-file crc matches.
+
+const UPLOAD_SESSIONS_JSON = "upload_sessions.json"
+const UPLOAD_SESSION_LIFE = time.Hour * 24
+const UPLOAD_SESSION_ID_LENGTH = 32
+const UPLOAD_CHUNK_LIMIT = 16 * 1024 * 1024
+const UPLOAD_METADATA_LIMIT = 4 * 1024 * 1024
+const HEADER_CHUNK_CRC = "X-Chunk-Crc32"
+const QUERY_UPLOAD_ID = "id"
+const QUERY_OFFSET = "offset"
+
+type UploadSession struct {
+	ID			string		`json:"id"`
+	Dir			string		`json:"dir"`
+	Base		string		`json:"base"`
+	Size		int64		`json:"size"`
+	Crc32		string		`json:"crc32"`
+	Offset		int64		`json:"offset"`
+	RunningCrc	uint32		`json:"runningCrc"`
+	MetaExts	[]string	`json:"metaExts"`
+	Updated		time.Time	`json:"updated"`
+
+	mu			sync.Mutex
+}
+
+type UploadSessionManager struct {
+	sessions	map[string] *UploadSession
+	records		map[string] json.RawMessage // sessions as stored, see record
+	mu			sync.Mutex
+}
+
+var gUploadSessions *UploadSessionManager
+
+func NewUploadSessionManager() *UploadSessionManager {
+
+	usm := &UploadSessionManager{}
+
+	usm.sessions = make(map[string]*UploadSession)
+	usm.records = make(map[string]json.RawMessage)
+
+	return usm
+
+}
+
+func (sess *UploadSession) progressPath() string {
+	return filepath.Join(sess.Dir, sess.Base) + "." + sess.ID + ".inprogress"
+}
+
+// Not in metadata dir where *.json are dir caches
+func (usm *UploadSessionManager) jsonPath() string {
+	return UPLOAD_SESSIONS_JSON
+}
+
+func (usm *UploadSessionManager) Load() error {
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	data, err := ioReadFile(usm.jsonPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &usm.sessions)
+	if err != nil {
+		return err
+	}
+	for _, sess := range usm.sessions {
+		usm.record(sess)
+	}
+
+	usm.expire()
+	logInfo("Loaded", len(usm.sessions), "upload sessions")
+
+	return nil
+
+}
+
+// record must be called while holding usm.mu and sess.mu unless sess is not shared yet,
+// others are stored as they were recorded since they may be being written
+func (usm *UploadSessionManager) record(sess *UploadSession) {
+
+	data, err := json.Marshal(sess)
+	if err != nil {
+		panic(err)
+	}
+	usm.records[sess.ID] = data
+
+}
+
+// store must be called while holding usm.mu
+func (usm *UploadSessionManager) store() {
+
+	data, err := json.Marshal(usm.records)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioWriteFile(usm.jsonPath(), data, 0644)
+	if err != nil {
+		logError("Failed to write upload sessions err:", err)
+	}
+
+}
+
+// expire must be called while holding usm.mu
+func (usm *UploadSessionManager) expire() {
+
+	now := time.Now()
+	for id, sess := range usm.sessions {
+		// Being written is not expired
+		if now.Sub(sess.Updated) <= UPLOAD_SESSION_LIFE || !sess.mu.TryLock() {
+			continue
+		}
+		logWarn("Upload session", id, "for", sess.Base, "expired")
+		ioRemove(sess.progressPath())
+		sess.removeMetadata()
+		sess.mu.Unlock()
+		delete(usm.sessions, id)
+		delete(usm.records, id)
+	}
+
+}
+
+func (usm *UploadSessionManager) Create(dir, name string, size int64, crc string) (*UploadSession, error) {
+
+	id, err := generateRandomString(UPLOAD_SESSION_ID_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &UploadSession{
+		ID:			id,
+		Dir:		dir,
+		Base:		recursiveNewName(dir, name),
+		Size:		size,
+		Crc32:		crc,
+		MetaExts:	make([]string, 0),
+		Updated:	time.Now(),
+	}
+
+	// Create empty file so that offset 0 is resumable
+	err = ioWriteFile(sess.progressPath(), []byte{}, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	usm.expire()
+	usm.sessions[id] = sess
+	usm.record(sess)
+	usm.store()
+
+	return sess, nil
+
+}
+
+func (usm *UploadSessionManager) Get(id string) (*UploadSession, bool) {
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	sess, ok := usm.sessions[id]
+	return sess, ok
+
+}
+
+// Registered must be called while holding sess.mu, a session removed is not written any more
+// since it is removed only while holding sess.mu
+func (usm *UploadSessionManager) Registered(sess *UploadSession) bool {
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	return usm.sessions[sess.ID] == sess
+
+}
+
+// Touch must be called while holding sess.mu
+func (usm *UploadSessionManager) Touch(sess *UploadSession) {
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	// Not recorded again once removed
+	if usm.sessions[sess.ID] != sess {
+		return
+	}
+	sess.Updated = time.Now()
+	usm.record(sess)
+	usm.store()
+
+}
+
+// Remove must be called while holding sess.mu
+func (usm *UploadSessionManager) Remove(sess *UploadSession) {
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	delete(usm.sessions, sess.ID)
+	delete(usm.records, sess.ID)
+	usm.store()
+
+}
+
+// removeMetadata removes the sidecar metadata files of the session not finished
+func (sess *UploadSession) removeMetadata() {
+	for _, ext := range sess.MetaExts {
+		ioRemove(filepath.Join(gAppInfo.MetadataDir, sess.Dir, sess.Base) + ext)
+	}
+}
+
+// WriteChunk appends chunk at offset after checking its crc and returns the new offset
+func (sess *UploadSession) WriteChunk(offset int64, chunk []byte, chunkCrc string) (int64, error) {
+
+	if offset != sess.Offset {
+		return sess.Offset, fmt.Errorf("Offset mismatch %d, expected %d", offset, sess.Offset)
+	}
+	if sess.Offset + int64(len(chunk)) > sess.Size {
+		return sess.Offset, fmt.Errorf("Chunk exceeds the file size %d", sess.Size)
+	}
+	if getCRC32OfBytes(chunk) != chunkCrc {
+		return sess.Offset, fmt.Errorf("Chunk crc mismatch %s", chunkCrc)
+	}
+
+	// Not created again once the session is removed
+	out, err := ioOpenFile(sess.progressPath(), os.O_WRONLY, 0644)
+	if err != nil {
+		return sess.Offset, err
+	}
+	defer out.Close()
+
+	// Seek instead of append so that a tail left by an interrupted write is overwritten
+	_, err = out.Seek(sess.Offset, io.SeekStart)
+	if err != nil {
+		return sess.Offset, err
+	}
+
+	for written := 0; written < len(chunk); {
+		n, err := out.Write(chunk[written:])
+		if err != nil {
+			return sess.Offset, err
+		}
+		written += n
+	}
+
+	sess.RunningCrc = crc32.Update(sess.RunningCrc, crc32.IEEETable, chunk)
+	sess.Offset += int64(len(chunk))
+
+	return sess.Offset, nil
+
+}
+
+// Finish checks the whole file crc, renames the file and sets its metadata
+func (sess *UploadSession) Finish() error {
+
+	crc := fmt.Sprintf("%08x", sess.RunningCrc)
+	if crc != sess.Crc32 {
+		sess.removeMetadata()
+		return fmt.Errorf("crc mismatch %s %s", sess.Crc32, crc)
+	}
+
+	// Name could have been taken while uploading
+	base := recursiveNewName(sess.Dir, sess.Base)
+	fullpath := filepath.Join(sess.Dir, base)
+	err := os.Rename(sess.progressPath(), fullpath)
+	if err != nil {
+		sess.removeMetadata()
+		return fmt.Errorf("Error changing name: %w", err)
+	}
+	if base != sess.Base {
+		metaDir := filepath.Join(gAppInfo.MetadataDir, sess.Dir)
+		for _, ext := range sess.MetaExts {
+			err := os.Rename(filepath.Join(metaDir, sess.Base) + ext, filepath.Join(metaDir, base) + ext)
+			if err != nil {
+				logWarn("Failed to rename metadata of", sess.Base, ext, err)
+			}
+		}
+	}
+	sess.Base = base
+
+	info, err := ioStat(fullpath)
+	if err != nil {
+		return fmt.Errorf("Error doing stat of uploaded file: %w", err)
+	}
+
+	return gMetadataManager.SetMetadata(sess.Dir, base, info, crc)
+
+}
+
+func uploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	// Create session
+	if r.Method == http.MethodPost {
+
+		dir, err := getAlbumDir(query.Get(QUERY_ALBUM))
+		if err != nil {
+			logHTTPRequest(r, -1, "getAlbumDir err:", err)
+			http.Error(w, "Invalid album", http.StatusBadRequest)
+			return
+		}
+		if _, ok := gMetadataManager.getCache(dir); !ok {
+			logHTTPRequest(r, -1, "Invalid directory:", dir)
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+
+		info := struct{
+			Name	string	`json:"name"`
+			Size	int64	`json:"size"`
+			Crc		string	`json:"crc"`
+		}{}
+		err = json.NewDecoder(r.Body).Decode(&info)
+		if err != nil || info.Name == "" || info.Size < 0 || len(info.Crc) != 8 {
+			logHTTPRequest(r, -1, "Malformed upload session request:", info, err)
+			http.Error(w, "Malformed upload session request", http.StatusBadRequest)
+			return
+		}
+
+		// Nothing to upload for a duplicate
+		action, loc := findDuplicateAction(query.Get(QUERY_DUPLICATE), dir, info.Size, info.Crc)
+		if action != "" {
+			result, err := applyDuplicateAction(action, dir, filepath.Base(info.Name), loc)
+			if err != nil {
+				logHTTPRequest(r, -1, "Failed to handle duplicate err:", err)
+				http.Error(w, "Failed to handle duplicate", http.StatusInternalServerError)
+				return
+			}
+			logHTTPRequest(r, -1, "UPLOAD DUPLICATE", action, info.Name, loc.Album, loc.Base)
+			serveJson(w, r, result)
+			return
+		}
+
+		sess, err := gUploadSessions.Create(dir, filepath.Base(info.Name), info.Size, info.Crc)
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to create upload session err:", err)
+			http.Error(w, "Failed to create upload session", http.StatusInternalServerError)
+			return
+		}
+
+		logHTTPRequest(r, -1, "UPLOAD SESSION", sess.ID, sess.Base, formatBytes(sess.Size))
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		serveJson(w, r, sess)
+		return
+
+	}
+
+	// Existing session
+	sess, ok := gUploadSessions.Get(query.Get(QUERY_UPLOAD_ID))
+	if !ok {
+		logHTTPRequest(r, -1, "Upload session not found")
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	// Aborted or finished by another request while waiting for the lock
+	if !gUploadSessions.Registered(sess) {
+		logHTTPRequest(r, -1, "Upload session removed", sess.ID)
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+
+		serveJson(w, r, sess)
+
+	case http.MethodDelete:
+
+		gUploadSessions.Remove(sess)
+		ioRemove(sess.progressPath())
+		sess.removeMetadata()
+		logHTTPRequest(r, -1, "UPLOAD ABORTED", sess.Base)
+
+	case http.MethodPut:
+
+		// Sidecar metadata
+		if query.Has(QUERY_METADATA) {
+
+			ext := query.Get(QUERY_METADATA)
+			if !slices.Contains(gMetaExts, ext) {
+				logHTTPRequest(r, -1, "Wrong upload metadata ext:", ext)
+				http.Error(w, "Wrong metadata extension", http.StatusBadRequest)
+				return
+			}
+
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, UPLOAD_METADATA_LIMIT))
+			if err != nil {
+				logHTTPRequest(r, -1, "Failed to read metadata err:", err)
+				http.Error(w, "Error reading metadata", http.StatusBadRequest)
+				return
+			}
+
+			fullpath := filepath.Join(gAppInfo.MetadataDir, sess.Dir, sess.Base) + ext
+			err = ioWriteFile(fullpath, data, 0644)
+			if err != nil {
+				logHTTPRequest(r, -1, fullpath, "ioWriteFile err:", err)
+				http.Error(w, "Error writing metadata", http.StatusInternalServerError)
+				return
+			}
+			sess.MetaExts = append(sess.MetaExts, ext)
+			gUploadSessions.Touch(sess)
+
+			logHTTPRequest(r, -1, sess.Base, ext)
+			serveJson(w, r, sess)
+			return
+
+		}
+
+		// Chunk
+		var offset int64
+		_, err := fmt.Sscan(query.Get(QUERY_OFFSET), &offset)
+		if err != nil {
+			logHTTPRequest(r, -1, "Malformed offset err:", err)
+			http.Error(w, "Malformed offset", http.StatusBadRequest)
+			return
+		}
+
+		chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, UPLOAD_CHUNK_LIMIT))
+		if err != nil {
+			logHTTPRequest(r, -1, "Failed to read chunk err:", err)
+			http.Error(w, "Error reading chunk", http.StatusBadRequest)
+			return
+		}
+
+		_, err = sess.WriteChunk(offset, chunk, r.Header.Get(HEADER_CHUNK_CRC))
+		if err != nil {
+			// Client is expected to resume from the offset of the session
+			logHTTPRequest(r, -1, sess.Base, "WriteChunk err:", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, mustJsonMarshal(sess))
+			return
+		}
+		gUploadSessions.Touch(sess)
+
+		if sess.Offset < sess.Size {
+			serveJson(w, r, sess)
+			return
+		}
+
+		// Whole file is received
+		err = sess.Finish()
+		gUploadSessions.Remove(sess)
+		if err != nil {
+			ioRemove(sess.progressPath())
+			logHTTPRequest(r, -1, sess.Base, "Failed to finish upload err:", err)
+			http.Error(w, "Failed to finish upload", http.StatusInternalServerError)
+			return
+		}
+
+		logHTTPRequest(r, -1, "UPLOAD", sess.Base, sess.Crc32)
+		serveJson(w, r, sess)
+
+	default:
+
+		logHTTPRequest(r, -1, "Invalid method for upload session")
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+
+	}
+
+}
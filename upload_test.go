@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadSessionWriteChunk(t *testing.T) {
+
+	newTestMetadataManager(t)
+	data := []byte("0123456789abcdef")
+	crc := fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+
+	usm := NewUploadSessionManager()
+	sess, err := usm.Create(gAppInfo.UploadDir, "a.txt", int64(len(data)), crc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	tests := []struct {
+		name	string
+		offset	int64
+		chunk	[]byte
+		crc		string
+		want	int64
+		err		bool
+	}{
+		{"first", 0, data[:6], getCRC32OfBytes(data[:6]), 6, false},
+		{"again", 0, data[:6], getCRC32OfBytes(data[:6]), 6, true},
+		{"gap", 8, data[8:], getCRC32OfBytes(data[8:]), 6, true},
+		{"chunk crc mismatch", 6, data[6:10], "00000000", 6, true},
+		{"beyond size", 6, append(data[6:], 'x'), getCRC32OfBytes(append(data[6:], 'x')), 6, true},
+		{"second", 6, data[6:10], getCRC32OfBytes(data[6:10]), 10, false},
+	}
+
+	for _, tt := range tests {
+		got, err := sess.WriteChunk(tt.offset, tt.chunk, tt.crc)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%s got %d, %v, want %d, error %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+
+	written, err := os.ReadFile(sess.progressPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != string(data[:10]) {
+		t.Errorf("written %q", written)
+	}
+
+}
+
+func TestUploadSessionResumeAndFinish(t *testing.T) {
+
+	newTestMetadataManager(t)
+	data := []byte("resumable upload body")
+	crc := fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+
+	usm := NewUploadSessionManager()
+	sess, err := usm.Create(gAppInfo.UploadDir, "a.txt", int64(len(data)), crc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.mu.Lock()
+	if _, err := sess.WriteChunk(0, data[:8], getCRC32OfBytes(data[:8])); err != nil {
+		t.Fatal(err)
+	}
+	usm.Touch(sess)
+	sess.mu.Unlock()
+
+	// Restart
+	usm = NewUploadSessionManager()
+	if err := usm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	sess, ok := usm.Get(sess.ID)
+	if !ok {
+		t.Fatal("session is not loaded")
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.Offset != 8 {
+		t.Fatalf("offset %d, want 8", sess.Offset)
+	}
+
+	if _, err := sess.WriteChunk(8, data[8:], getCRC32OfBytes(data[8:])); err != nil {
+		t.Fatal(err)
+	}
+	// Name taken while uploading
+	must(os.WriteFile(filepath.Join(gAppInfo.UploadDir, "a.txt"), []byte("other"), 0644))
+	if err := sess.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	usm.Remove(sess)
+
+	if sess.Base == "a.txt" {
+		t.Errorf("base %s is not renamed", sess.Base)
+	}
+	got, err := os.ReadFile(filepath.Join(gAppInfo.UploadDir, sess.Base))
+	if err != nil || string(got) != string(data) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := os.Stat(sess.progressPath()); !os.IsNotExist(err) {
+		t.Errorf("progress file is left %v", err)
+	}
+	meta, ok := gMetadataManager.GetMetadata(gAppInfo.UploadDir, sess.Base)
+	if !ok || meta.Crc32 != crc || meta.Size != int64(len(data)) {
+		t.Errorf("metadata %+v", meta)
+	}
+
+	usm = NewUploadSessionManager()
+	if err := usm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usm.Get(sess.ID); ok {
+		t.Error("finished session is loaded")
+	}
+
+}
+
+func TestUploadSessionFinishCrcMismatch(t *testing.T) {
+
+	newTestMetadataManager(t)
+	data := []byte("body")
+
+	usm := NewUploadSessionManager()
+	sess, err := usm.Create(gAppInfo.UploadDir, "a.txt", int64(len(data)), "00000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sidecar := filepath.Join(gAppInfo.MetadataDir, sess.Dir, sess.Base) + META_EXT_THUMB
+	must(os.MkdirAll(filepath.Dir(sidecar), 0755))
+	must(os.WriteFile(sidecar, []byte("webp"), 0644))
+	sess.MetaExts = append(sess.MetaExts, META_EXT_THUMB)
+
+	if _, err := sess.WriteChunk(0, data, getCRC32OfBytes(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Finish(); err == nil {
+		t.Fatal("want crc mismatch")
+	}
+	if _, err := os.Stat(filepath.Join(gAppInfo.UploadDir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file is renamed %v", err)
+	}
+	if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+		t.Errorf("sidecar is left %v", err)
+	}
+
+}
+
+func TestUploadSessionRemovedWhileWaiting(t *testing.T) {
+
+	newTestMetadataManager(t)
+	data := []byte("body")
+
+	usm := NewUploadSessionManager()
+	sess, err := usm.Create(gAppInfo.UploadDir, "a.txt", int64(len(data)), getCRC32OfBytes(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Aborted by another request after this one got the session
+	sess.mu.Lock()
+	usm.Remove(sess)
+	os.Remove(sess.progressPath())
+	sess.mu.Unlock()
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if usm.Registered(sess) {
+		t.Error("removed session is registered")
+	}
+	if _, err := sess.WriteChunk(0, data, getCRC32OfBytes(data)); err == nil {
+		t.Error("chunk is written to a removed session")
+	}
+	if _, err := os.Stat(sess.progressPath()); !os.IsNotExist(err) {
+		t.Errorf("progress file is created again %v", err)
+	}
+	usm.Touch(sess)
+
+	usm = NewUploadSessionManager()
+	if err := usm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usm.Get(sess.ID); ok {
+		t.Error("removed session is stored again")
+	}
+
+}
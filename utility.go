@@ -3,6 +3,7 @@ package main
 
 import (
     "container/list"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -19,6 +20,7 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"net/http"
 	"path/filepath"
 	"mime"
 	"os"
@@ -53,6 +55,15 @@ func (sem Semaphore) Acquire() bool {
 	sem.ch <- struct{}{}
 	return true
 }
+// AcquireContext gives up when the context is done
+func (sem Semaphore) AcquireContext(ctx context.Context) bool {
+	select {
+	case sem.ch <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 func (sem Semaphore) Release() {
 	<-sem.ch
 }
@@ -448,7 +459,7 @@ func readSimplePayloadHeader(reader *bufio.Reader) (string, int, error) {
 	msgLen, err := strconv.Atoi(lengthStr)
 	if err != nil {
 		// protocol error
-		return "", 0, fmt.Errorf("Invalid length %d in header %s", lengthStr, header)
+		return "", 0, fmt.Errorf("Invalid length %s in header %s", lengthStr, header)
 	}
 	if msgLen < 0 {
 		return "", 0, fmt.Errorf("Negative length: %d", msgLen)
@@ -699,11 +710,45 @@ func getCRC32OfFile(fullpath string) (string, error) {
 	return fmt.Sprintf("%08x", hasher.Sum32()), nil
 }
 
+func copyFile(src, dst string) error {
+
+	in, err := ioOpen(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioOpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+
+}
+
 func getCRC32OfBytes(data []byte) string {
 	crc32Hash := crc32.ChecksumIEEE(data)
 	return fmt.Sprintf("%08x", crc32Hash)
 }
 
+// etagMatches tells whether If-None-Match of the request lists the ETag, compared weakly
+func etagMatches(r *http.Request, etag string) bool {
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		if match == "*" || strings.TrimPrefix(match, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+
+}
+
 func mimeTypeByName(name string) string {
 	return mime.TypeByExtension(filepath.Ext(name))
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Change detection by file system events
+//
+// Where supported, the watcher queues the names of changed entries and they are applied
+// to the cache after WATCH_REFRESH_DELAY without reading the whole dir.
+// Dirs that are not watched are updated by the throttled full rescans as before.
+
+const WATCH_REFRESH_DELAY = time.Millisecond * 300
+
+type metadataWatcher interface {
+	Add(cache *metadataCache) error
+	Remove(cache *metadataCache)
+}
+
+// Watch starts the watcher, must be called before registering dirs
+func (mgr *MetadataManager) Watch() error {
+
+	watcher, err := NewMetadataWatcher(mgr)
+	if err != nil {
+		return err
+	}
+	mgr.watcher = watcher
+
+	return nil
+
+}
+
+// Watched reports whether the changes of the dir are applied by events
+func (mgr *MetadataManager) Watched(dir string) bool {
+
+	cache, ok := mgr.getCache(dir)
+	if !ok {
+		return false
+	}
+
+	return cache.watched.Load()
+
+}
+
+// rescan updates all dirs as events are lost
+func (mgr *MetadataManager) rescan() {
+
+	logWarn("Rescanning all dirs as file system events are lost")
+	for _, dir := range mgr.Dirs() {
+		if err := mgr.UpdateDir(dir); err != nil {
+			logWarn("Failed to rescan", dir, err)
+		}
+	}
+
+}
+
+func (cache *metadataCache) queueRefresh(base string) {
+
+	cache.pendingMu.Lock()
+	cache.pending[base] = struct{}{}
+	cache.pendingMu.Unlock()
+
+	cache.refreshLater()
+
+}
+
+// refresh applies the queued entries to the cache
+func (cache *metadataCache) refresh() {
+
+	cache.pendingMu.Lock()
+	pending := cache.pending
+	cache.pending = make(map[string]struct{})
+	cache.pendingMu.Unlock()
+
+	mgr := cache.mgr
+	mgr.updateMu.Lock()
+	defer mgr.updateMu.Unlock()
+
+	// Unregistered meanwhile
+	dir := cache.dir
+	if cache1, ok := mgr.getCache(dir); !ok || cache1 != cache {
+		return
+	}
+
+	cache.bodyMu.Lock()
+
+	changed := make([]string, 0)
+	addedDirs := make([]string, 0)
+	removedDirs := make([]string, 0)
+	playlist := false
+
+	for base := range pending {
+
+		fullpath := filepath.Join(dir, base)
+		meta, ok := cache.body.MetaMap[base]
+
+		info, err := ioLstat(fullpath)
+		if err != nil {
+
+			if !ok {
+				continue
+			}
+
+			// Removed
+			delete(cache.body.MetaMap, base)
+			removeMetadataSidecars(dir, base)
+			if meta.IsDir {
+				removedDirs = append(removedDirs, fullpath)
+			}
+			pl := removeFromPlaylist(cache.body.Playlist, base)
+			if len(pl) != len(cache.body.Playlist) {
+				cache.body.Playlist = pl
+				playlist = true
+			}
+			if cache.removeFromPlaylists(getAlbumOfDir(dir), base) {
+				playlist = true
+			}
+			changed = append(changed, base)
+			continue
+
+		}
+
+		if !ok {
+			meta = &Metadata{}
+			cache.body.MetaMap[base] = meta
+			if info.IsDir() {
+				addedDirs = append(addedDirs, fullpath)
+			}
+		}
+
+		if meta.fill(fullpath, info) {
+			changed = append(changed, base)
+		}
+		if !ok && isAudio(meta.MimeType) {
+			cache.body.Playlist = append(cache.body.Playlist, base)
+			playlist = true
+		}
+		cache.scheduleBake(base, meta)
+
+	}
+
+	if len(changed) > 0 || playlist {
+		changed = append(changed, cache.updateAlbumGain()...)
+		cache.save(playlist, changed...)
+		logInfo("Refreshed cache of", dir, "-", len(changed), "changed")
+	}
+
+	cache.bodyMu.Unlock()
+
+	// After unlock as registration locks the cache map
+	mgr.syncChildren(addedDirs, removedDirs)
+
+	// New dirs are read once, updateMu is released by then
+	for _, dir1 := range addedDirs {
+		go func() {
+			if err := mgr.UpdateDir(dir1); err != nil {
+				logWarn(fmt.Errorf("Failed to cache dir %s: %w", dir1, err))
+			}
+		}()
+	}
+
+}
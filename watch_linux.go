@@ -0,0 +1,140 @@
+// +build linux,!386
+// linux and not 386
+// iSH is excluded as inotify is unreliable there
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const WATCH_INOTIFY_MASK = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+type inotifyWatcher struct {
+	mgr			*MetadataManager
+	fd			int
+
+	caches		map[int] *metadataCache // by watch descriptor
+	mu			sync.Mutex
+}
+
+func NewMetadataWatcher(mgr *MetadataManager) (metadataWatcher, error) {
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init inotify: %w", err)
+	}
+
+	watcher := &inotifyWatcher{}
+
+	watcher.mgr		= mgr
+	watcher.fd		= fd
+	watcher.caches	= make(map[int]*metadataCache)
+
+	go watcher.run()
+
+	return watcher, nil
+
+}
+
+func (watcher *inotifyWatcher) Add(cache *metadataCache) error {
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	wd, err := unix.InotifyAddWatch(watcher.fd, cache.dir, WATCH_INOTIFY_MASK)
+	if err != nil {
+		return fmt.Errorf("Failed to watch %s: %w", cache.dir, err)
+	}
+
+	watcher.caches[wd] = cache
+	cache.wd = wd
+	cache.watched.Store(true)
+
+	return nil
+
+}
+
+func (watcher *inotifyWatcher) Remove(cache *metadataCache) {
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if !cache.watched.Load() {
+		return
+	}
+	cache.watched.Store(false)
+
+	// Fails when the dir is already removed
+	unix.InotifyRmWatch(watcher.fd, uint32(cache.wd))
+	delete(watcher.caches, cache.wd)
+
+}
+
+func (watcher *inotifyWatcher) run() {
+
+	buf := make([]byte, 64 * (unix.SizeofInotifyEvent + unix.PathMax))
+
+	for {
+
+		n, err := unix.Read(watcher.fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			logError("Failed to read inotify events, watching stopped:", err)
+			return
+		}
+
+		for offset := 0; offset + unix.SizeofInotifyEvent <= n; {
+
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := ""
+			if event.Len > 0 {
+				bytes := buf[offset + unix.SizeofInotifyEvent : offset + unix.SizeofInotifyEvent + int(event.Len)]
+				for i, b := range bytes {
+					if b == 0 {
+						bytes = bytes[:i]
+						break
+					}
+				}
+				name = string(bytes)
+			}
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			watcher.handle(event, name)
+
+		}
+
+	}
+
+}
+
+func (watcher *inotifyWatcher) handle(event *unix.InotifyEvent, name string) {
+
+	if event.Mask & unix.IN_Q_OVERFLOW != 0 {
+		go watcher.mgr.rescan()
+		return
+	}
+
+	watcher.mu.Lock()
+	cache, ok := watcher.caches[int(event.Wd)]
+	if ok && event.Mask & unix.IN_IGNORED != 0 {
+		// Removed dir
+		delete(watcher.caches, int(event.Wd))
+		cache.watched.Store(false)
+	}
+	watcher.mu.Unlock()
+
+	if !ok || name == "" {
+		return
+	}
+
+	cache.queueRefresh(name)
+
+}
@@ -0,0 +1,13 @@
+// +build !linux 386
+// not linux or 386
+// build for iSH and others
+
+package main
+
+import (
+	"fmt"
+)
+
+func NewMetadataWatcher(mgr *MetadataManager) (metadataWatcher, error) {
+	return nil, fmt.Errorf("File system events are not supported, dirs are rescanned")
+}
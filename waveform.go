@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Audio waveform
+//
+// GET /view/B?album=A&metadata=_waveform.json returns the waveform of the audio B
+//
+// Audio is decoded by native ffmpeg to mono PCM of WAVEFORM_SAMPLE_RATE and each bucket of
+// samples_per_pixel samples gets its min, max and RMS. The file is in the audiowaveform JSON
+// format (version 2, 8 bits) with "rms" added, about WAVEFORM_BUCKETS long whatever the duration.
+
+const WAVEFORM_SAMPLE_RATE = 8000
+const WAVEFORM_BUCKETS = 1000
+const WAVEFORM_MIN_SAMPLES_PER_PIXEL = 64
+const WAVEFORM_CHUNK = 64 * 1024
+
+// Recorded in the metadata so that the player knows it is there
+type MetadataWaveform struct {
+	Length			int		`json:"length"`
+	SamplesPerPixel	int		`json:"samplesPerPixel"`
+}
+
+// Waveform is the audiowaveform JSON format
+type Waveform struct {
+	Version			int		`json:"version"`
+	Channels		int		`json:"channels"`
+	SampleRate		int		`json:"sample_rate"`
+	SamplesPerPixel	int		`json:"samples_per_pixel"`
+	Bits			int		`json:"bits"`
+	Length			int		`json:"length"`
+	Data			[]int8	`json:"data"` // min and max of each bucket
+	RMS				[]int8	`json:"rms"`
+}
+
+func waveformSamplesPerPixel(media *MediaInfo) int {
+
+	// 10 buckets a second when unknown
+	if media == nil || media.Duration <= 0 {
+		return WAVEFORM_SAMPLE_RATE / 10
+	}
+
+	spp := int(math.Ceil(media.Duration * WAVEFORM_SAMPLE_RATE / WAVEFORM_BUCKETS))
+	if spp < WAVEFORM_MIN_SAMPLES_PER_PIXEL {
+		spp = WAVEFORM_MIN_SAMPLES_PER_PIXEL
+	}
+
+	return spp
+
+}
+
+// waveformBuilder takes 16 bit samples and makes buckets of them
+type waveformBuilder struct {
+	waveform	*Waveform
+	count		int
+	min			int
+	max			int
+	squares		float64
+}
+
+func newWaveformBuilder(spp int) *waveformBuilder {
+	return &waveformBuilder{
+		waveform: &Waveform{
+			Version:			2,
+			Channels:			1,
+			SampleRate:			WAVEFORM_SAMPLE_RATE,
+			SamplesPerPixel:	spp,
+			Bits:				8,
+			Data:				make([]int8, 0, WAVEFORM_BUCKETS * 2),
+			RMS:				make([]int8, 0, WAVEFORM_BUCKETS),
+		},
+		min: math.MaxInt16,
+		max: math.MinInt16,
+	}
+}
+
+func (wb *waveformBuilder) add(sample int16) {
+
+	s := int(sample)
+	if s < wb.min {
+		wb.min = s
+	}
+	if s > wb.max {
+		wb.max = s
+	}
+	wb.squares += float64(s) * float64(s)
+	wb.count++
+
+	if wb.count == wb.waveform.SamplesPerPixel {
+		wb.flush()
+	}
+
+}
+
+// flush closes the bucket, 16 bits are shifted to 8
+func (wb *waveformBuilder) flush() {
+
+	if wb.count == 0 {
+		return
+	}
+
+	rms := math.Sqrt(wb.squares / float64(wb.count))
+	wb.waveform.Data = append(wb.waveform.Data, int8(wb.min >> 8), int8(wb.max >> 8))
+	wb.waveform.RMS = append(wb.waveform.RMS, int8(math.Min(rms / 256, math.MaxInt8)))
+	wb.waveform.Length++
+
+	wb.count = 0
+	wb.min = math.MaxInt16
+	wb.max = math.MinInt16
+	wb.squares = 0
+
+}
+
+// bakeWaveform makes the waveform of the audio at outpath
+func bakeWaveform(fullpath, outpath string, media *MediaInfo) (*MetadataWaveform, error) {
+
+	devNull, err := ioOpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer devNull.Close()
+
+	pr, pw, err := ioPipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "error",
+		"-i", fullpath, "-vn",
+		"-ac", "1", "-ar", strconv.Itoa(WAVEFORM_SAMPLE_RATE),
+		"-f", "s16le", "-c:a", "pcm_s16le", "pipe:1",
+	}
+	ffErr := make(chan error, 1)
+	go func() {
+		ffErr <- executeFFmpeg(args, pw, devNull)
+		pw.Close()
+	}()
+
+	wb := newWaveformBuilder(waveformSamplesPerPixel(media))
+	buf := make([]byte, WAVEFORM_CHUNK)
+	carry := 0 // odd byte of the previous read
+	for {
+		n, err := pr.Read(buf[carry:])
+		n += carry
+		even := n &^ 1
+		for i := 0; i < even; i += 2 {
+			wb.add(int16(binary.LittleEndian.Uint16(buf[i:])))
+		}
+		carry = n - even
+		if carry > 0 {
+			buf[0] = buf[even]
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	wb.flush()
+
+	err = <-ffErr
+	if err != nil {
+		return nil, err
+	}
+	if wb.waveform.Length == 0 {
+		return nil, fmt.Errorf("No audio is decoded")
+	}
+
+	data, err := json.Marshal(wb.waveform)
+	if err != nil {
+		return nil, err
+	}
+	err = ioWriteFile(outpath, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetadataWaveform{
+		Length:				wb.waveform.Length,
+		SamplesPerPixel:	wb.waveform.SamplesPerPixel,
+	}, nil
+
+}